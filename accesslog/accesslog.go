@@ -0,0 +1,197 @@
+// Accesslog writes a line for every request proxied to a service.
+// The requests matching no service (404) and the admin requests are not logged.
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const redacted = "REDACTED"
+
+// parameters that are always redacted
+var alwaysRedacted = []string{"$app_key"}
+
+// Entry describes a request handled by the proxy.
+type Entry struct {
+	Time       time.Time `json:"time"`
+	RequestId  string    `json:"requestId"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Method     string    `json:"method"`
+	URL        string    `json:"url"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	Referer    string    `json:"referer"`
+	UserAgent  string    `json:"userAgent"`
+	AppId      string    `json:"appId"`
+	Service    string    `json:"service"`
+	Backend    string    `json:"backend"`
+	Attempts   int       `json:"attempts"`
+	// Duration is the total time spent on the request.
+	Duration        time.Duration `json:"duration"`
+	UpstreamLatency time.Duration `json:"upstreamLatency"`
+	AuthLatency     time.Duration `json:"authLatency"`
+}
+
+// A Formatter turns an entry into a line of the log (without the newline).
+type Formatter interface {
+	Format(e *Entry) ([]byte, error)
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// CombinedFormatter uses the Combined Log Format of Apache,
+// with the app id as user.
+type CombinedFormatter struct{}
+
+func (f CombinedFormatter) Format(e *Entry) ([]byte, error) {
+	host := e.RemoteAddr
+	if i := strings.LastIndex(host, ":"); i > 0 {
+		host = host[:i]
+	}
+	line := fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %d "%s" "%s"`,
+		dash(host), dash(e.AppId), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, e.URL, e.Proto, e.Status, e.Bytes, dash(e.Referer), dash(e.UserAgent))
+	return []byte(line), nil
+}
+
+// JSONFormatter writes every entry as a JSON object, durations in seconds.
+type JSONFormatter struct{}
+
+func (f JSONFormatter) Format(e *Entry) ([]byte, error) {
+	type alias Entry
+	return json.Marshal(&struct {
+		*alias
+		Duration        float64 `json:"duration"`
+		UpstreamLatency float64 `json:"upstreamLatency"`
+		AuthLatency     float64 `json:"authLatency"`
+	}{
+		alias:           (*alias)(e),
+		Duration:        e.Duration.Seconds(),
+		UpstreamLatency: e.UpstreamLatency.Seconds(),
+		AuthLatency:     e.AuthLatency.Seconds(),
+	})
+}
+
+// TemplateFormatter formats the entries with a text/template,
+// e.g. "{{.RemoteAddr}} {{.AppId}} {{.Status}} {{.UpstreamLatency}}"
+type TemplateFormatter struct {
+	Template *template.Template
+}
+
+func NewTemplateFormatter(text string) (*TemplateFormatter, error) {
+	t, err := template.New("accesslog").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &TemplateFormatter{Template: t}, nil
+}
+
+func (f *TemplateFormatter) Format(e *Entry) ([]byte, error) {
+	var buf bytes.Buffer
+	err := f.Template.Execute(&buf, e)
+	return buf.Bytes(), err
+}
+
+// the names of the template formats start with it, e.g. "template:{{.AppId}} {{.Status}}"
+const templatePrefix = "template:"
+
+// NewFormatter returns the formatter called name ("combined" or "json"),
+// or the template following "template:".
+func NewFormatter(name string) (Formatter, error) {
+	switch name {
+	case "combined", "":
+		return CombinedFormatter{}, nil
+	case "json":
+		return JSONFormatter{}, nil
+	}
+	if strings.HasPrefix(name, templatePrefix) {
+		return NewTemplateFormatter(strings.TrimPrefix(name, templatePrefix))
+	}
+	return nil, fmt.Errorf("unknown access log format %q", name)
+}
+
+// Redact hides the values of the sensitive query parameters of rawurl,
+// and those of $app_key in any case.
+// It works on the raw query, so that the URLs that don't parse
+// or have badly escaped values are redacted too.
+func Redact(rawurl string, params []string) string {
+	i := strings.Index(rawurl, "?")
+	if i < 0 {
+		return rawurl
+	}
+	query, fragment := rawurl[i+1:], ""
+	if j := strings.Index(query, "#"); j >= 0 {
+		query, fragment = query[:j], query[j:]
+	}
+
+	pairs := strings.Split(query, "&")
+	changed := false
+	for n, pair := range pairs {
+		rawKey := pair
+		if j := strings.Index(pair, "="); j >= 0 {
+			rawKey = pair[:j]
+		}
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil {
+			key = rawKey
+		}
+		if isRedacted(key, params) {
+			pairs[n] = rawKey + "=" + redacted
+			changed = true
+		}
+	}
+	if !changed {
+		return rawurl
+	}
+	return rawurl[:i+1] + strings.Join(pairs, "&") + fragment
+}
+
+func isRedacted(key string, params []string) bool {
+	for _, lists := range [][]string{alwaysRedacted, params} {
+		for _, param := range lists {
+			if key == param {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Logger writes the entries to Out.
+type Logger struct {
+	Formatter Formatter
+	Out       io.Writer
+	// query parameters whose values must not be logged
+	Redact []string
+
+	mu sync.Mutex
+}
+
+func (l *Logger) Log(e *Entry) {
+	e.URL = Redact(e.URL, l.Redact)
+	line, err := l.Formatter.Format(e)
+	if err != nil {
+		logger.Warning("Can't format access log entry: ", err.Error())
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.Out.Write(append(line, '\n')); err != nil {
+		logger.Warning("Can't write access log: ", err.Error())
+	}
+}
@@ -0,0 +1,116 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEntry() *Entry {
+	return &Entry{
+		Time:            time.Date(2014, 1, 10, 12, 30, 0, 0, time.UTC),
+		RemoteAddr:      "10.0.0.1:1234",
+		Method:          "GET",
+		URL:             "/service1/v1?text=hello&$app_id=MyApp&$app_key=MyKey&token=secret",
+		Proto:           "HTTP/1.1",
+		Status:          200,
+		Bytes:           42,
+		UserAgent:       "curl/7.30",
+		AppId:           "MyApp",
+		Service:         "service1",
+		Backend:         "example.com",
+		Attempts:        2,
+		UpstreamLatency: 1500 * time.Millisecond,
+	}
+}
+
+func TestRedact(t *testing.T) {
+	out := Redact("/service1/v1?text=hello&$app_key=MyKey&token=secret", []string{"token"})
+	if strings.Contains(out, "MyKey") || strings.Contains(out, "secret") || !strings.Contains(out, "text=hello") {
+		t.Error("Sensitive parameters are not redacted:", out)
+	}
+
+	// the URLs that don't parse and the badly escaped values are redacted as well
+	for _, raw := range []string{"/service1/v1%zz?$app_key=MyKey&token=secret", "/service1/v1?%24app_key=My%zzKey&token=secret#top"} {
+		if out := Redact(raw, []string{"token"}); strings.Contains(out, "MyKey") || strings.Contains(out, "secret") {
+			t.Error("Sensitive parameters are not redacted:", out)
+		}
+	}
+
+	unchanged := "/service1/v1?b=2&a=1"
+	if out := Redact(unchanged, nil); out != unchanged {
+		t.Error("URLs without sensitive parameters should not change, got", out)
+	}
+}
+
+func TestFormatters(t *testing.T) {
+	var buf bytes.Buffer
+	l := &Logger{Formatter: CombinedFormatter{}, Out: &buf}
+	l.Log(testEntry())
+
+	expected := `10.0.0.1 - MyApp [10/Jan/2014:12:30:00 +0000] "GET /service1/v1?text=hello&$app_id=MyApp&$app_key=REDACTED&token=secret HTTP/1.1" 200 42 "-" "curl/7.30"` + "\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, buf.String())
+	}
+
+	buf.Reset()
+	l = &Logger{Formatter: JSONFormatter{}, Out: &buf}
+	l.Log(testEntry())
+	var v map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &v); err != nil {
+		t.Fatal("Invalid JSON: ", err)
+	}
+	if v["upstreamLatency"] != 1.5 || v["backend"] != "example.com" || v["attempts"] != 2.0 {
+		t.Error("Wrong JSON entry:", buf.String())
+	}
+
+	buf.Reset()
+	formatter, err := NewFormatter("template:{{.AppId}} {{.Status}} {{.Backend}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l = &Logger{Formatter: formatter, Out: &buf}
+	l.Log(testEntry())
+	if buf.String() != "MyApp 200 example.com\n" {
+		t.Error("Wrong template output:", buf.String())
+	}
+
+	// a misspelled name is not a template
+	if _, err := NewFormatter("jsno"); err == nil {
+		t.Error("Unknown formats should be refused")
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	f, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		f.Write([]byte(line))
+	}
+
+	for file, expected := range map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"} {
+		content, _ := ioutil.ReadFile(file)
+		if string(content) != expected {
+			t.Errorf("Expected %q in %s, got %q", expected, file, content)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Error("Only 2 backups should be kept")
+	}
+}
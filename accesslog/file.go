@@ -0,0 +1,91 @@
+package accesslog
+
+import (
+	"fmt"
+	log "github.com/gigaroby/gopherlog"
+	"os"
+	"sync"
+)
+
+var (
+	logger = log.GetLogger("authproxy.accesslog")
+)
+
+// RotatingFile is a file that is rotated when it grows bigger than MaxSize:
+// path is renamed to path.1, path.1 to path.2 and so on, keeping MaxBackups old files.
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *RotatingFile) backupPath(n int) string {
+	return fmt.Sprintf("%s.%d", f.Path, n)
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	os.Remove(f.backupPath(f.MaxBackups))
+	for n := f.MaxBackups - 1; n > 0; n-- {
+		os.Rename(f.backupPath(n), f.backupPath(n+1))
+	}
+	if f.MaxBackups > 0 {
+		if err := os.Rename(f.Path, f.backupPath(1)); err != nil {
+			logger.Warning("Can't rotate access log: ", err.Error())
+		}
+	} else {
+		os.Remove(f.Path)
+	}
+	return f.open()
+}
+
+func (f *RotatingFile) Write(p []byte) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.MaxSize {
+		if err = f.rotate(); err != nil {
+			return
+		}
+	}
+
+	n, err = f.file.Write(p)
+	f.size += int64(n)
+	return
+}
+
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,128 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/gigaroby/authproxy/accesslog"
+	"github.com/gigaroby/authproxy/ioextra"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthHandle lets through to Handler only the requests authenticated
+// with any of the configured methods, and writes all of them to Audit.
+// With no method configured every request is let through.
+type AuthHandle struct {
+	Handler http.Handler
+	// Token is expected in "Authorization: Bearer <token>".
+	Token string
+	// Users maps the basic auth usernames to their passwords.
+	Users map[string]string
+	// ClientCert accepts the requests with a verified TLS client certificate,
+	// the listener must be configured to verify them.
+	ClientCert bool
+	Audit      *AuditLog
+}
+
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// principal returns who sent the request, or "" if it is not authenticated.
+func (h *AuthHandle) principal(req *http.Request) string {
+	if h.ClientCert && req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		return "cert:" + req.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+
+	if h.Token != "" {
+		auth := req.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") && equal(auth[len("Bearer "):], h.Token) {
+			return "token"
+		}
+	}
+
+	if len(h.Users) > 0 {
+		if user, password, ok := req.BasicAuth(); ok {
+			if expected, found := h.Users[user]; found && equal(password, expected) {
+				return "user:" + user
+			}
+		}
+	}
+	return ""
+}
+
+func (h *AuthHandle) open() bool {
+	return h.Token == "" && len(h.Users) == 0 && !h.ClientCert
+}
+
+func (h *AuthHandle) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rw := ioextra.NewResponseWriter(w)
+
+	principal := h.principal(req)
+	if principal == "" && h.open() {
+		principal = "anonymous"
+	}
+	if h.Audit != nil {
+		defer func() { h.Audit.Log(req, principal, rw.Status) }()
+	}
+
+	if principal == "" {
+		if len(h.Users) > 0 {
+			rw.Header().Set("WWW-Authenticate", `Basic realm="authproxy admin"`)
+		}
+		writeResponse(rw, &responseJson{Error: true, Message: "Authentication required", Code: "error.unauthorized", Status: 401})
+		return
+	}
+	h.Handler.ServeHTTP(rw, req)
+}
+
+// AuditEntry describes a request to the admin endpoints.
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Principal  string    `json:"principal"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Method     string    `json:"method"`
+	URL        string    `json:"url"`
+	Target     string    `json:"target,omitempty"` // the backend added, removed or drained
+	Status     int       `json:"status"`
+	Allowed    bool      `json:"allowed"`
+}
+
+// AuditLog writes an AuditEntry per line, as JSON.
+type AuditLog struct {
+	Out io.Writer
+
+	mu sync.Mutex
+}
+
+// auditTarget is the url parameter of req, from the form only when the handler
+// read it: the bodies of the requests refused are never read.
+func auditTarget(req *http.Request) string {
+	if req.Form != nil {
+		return req.Form.Get("url")
+	}
+	return req.URL.Query().Get("url")
+}
+
+func (a *AuditLog) Log(req *http.Request, principal string, status int) {
+	entry := &AuditEntry{
+		Time:       time.Now(),
+		Principal:  principal,
+		RemoteAddr: req.RemoteAddr,
+		Method:     req.Method,
+		URL:        accesslog.Redact(req.URL.String(), nil),
+		Target:     auditTarget(req),
+		Status:     status,
+		Allowed:    principal != "",
+	}
+	line, _ := json.Marshal(entry)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.Out.Write(append(line, '\n')); err != nil {
+		logger.Warning("Can't write audit log: ", err.Error())
+	}
+}
@@ -0,0 +1,83 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuthHandle(t *testing.T) {
+	var audit bytes.Buffer
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(200)
+	})
+	h := &AuthHandle{
+		Handler: ok,
+		Token:   "secret",
+		Users:   map[string]string{"admin": "pa:ss"},
+		Audit:   &AuditLog{Out: &audit},
+	}
+
+	cases := []struct {
+		setup    func(req *http.Request)
+		expected int
+	}{
+		{func(req *http.Request) {}, 401},
+		{func(req *http.Request) { req.Header.Set("Authorization", "Bearer wrong") }, 401},
+		{func(req *http.Request) { req.Header.Set("Authorization", "Bearer secret") }, 200},
+		{func(req *http.Request) { req.SetBasicAuth("admin", "wrong") }, 401},
+		{func(req *http.Request) { req.SetBasicAuth("admin", "pa:ss") }, 200},
+	}
+
+	for i, c := range cases {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost/admin/credits?$app_id=MyApp&$app_key=MyKey", nil)
+		c.setup(req)
+		h.ServeHTTP(rw, req)
+		if rw.Code != c.expected {
+			t.Errorf("Case %d: expected %d, got %d", i, c.expected, rw.Code)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	if len(lines) != len(cases) {
+		t.Fatalf("Expected %d audit entries, got %d", len(cases), len(lines))
+	}
+	var entry AuditEntry
+	if err := json.Unmarshal([]byte(lines[4]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Principal != "user:admin" || !entry.Allowed || entry.Status != 200 {
+		t.Error("Wrong audit entry:", lines[4])
+	}
+	if strings.Contains(audit.String(), "MyKey") {
+		t.Error("The app key should not be in the audit log")
+	}
+}
+
+func TestAuditLogTarget(t *testing.T) {
+	var audit bytes.Buffer
+	h := &AuthHandle{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			req.FormValue("url")
+		}),
+		Token: "secret",
+		Audit: &AuditLog{Out: &audit},
+	}
+
+	req, _ := http.NewRequest("POST", "http://localhost/admin/backends/service1/drain", strings.NewReader("url=http%3A%2F%2Fexample.com%2Fservice1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer secret")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	var entry AuditEntry
+	if err := json.Unmarshal(audit.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Target != "http://example.com/service1" {
+		t.Error("The audit entry should have the backend changed, got", audit.String())
+	}
+}
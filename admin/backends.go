@@ -0,0 +1,98 @@
+package admin
+
+import (
+	"encoding/json"
+	"github.com/gigaroby/authproxy/aerrors"
+	"github.com/gigaroby/authproxy/proxy"
+	"net/http"
+	"strings"
+)
+
+// BackendsManager knows the backends of the services and can change them at runtime.
+// Backends are identified by their URL.
+type BackendsManager interface {
+	Backends() map[string][]proxy.BackendStatus
+	AddBackend(service, url string) error
+	RemoveBackend(service, url string) error
+	DrainBackend(service, url string) error
+}
+
+// BackendsHandle lists the backends of the services below Prefix (GET) and
+// of a single service below Prefix/{service}, where a backend can be added (POST)
+// or removed (DELETE), and drained below Prefix/{service}/drain (POST).
+// The backend is the url parameter, in the query or in a form.
+type BackendsHandle struct {
+	Manager BackendsManager
+	Prefix  string
+}
+
+func writeResponse(rw http.ResponseWriter, res *responseJson) {
+	out, _ := json.Marshal(res)
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(res.Status)
+	rw.Write(out)
+}
+
+func writeError(rw http.ResponseWriter, err error) {
+	res := &responseJson{Error: true, Message: err.Error(), Status: 500, Code: "error.internalServerError"}
+	if rErr, ok := err.(aerrors.ResponseError); ok {
+		res.Status = rErr.Status
+		res.Code = rErr.Code
+	}
+	writeResponse(rw, res)
+}
+
+var (
+	errNotFound         = aerrors.ResponseError{Status: 404, Message: "API endpoint not found", Code: "error.notFound"}
+	errMethodNotAllowed = aerrors.ResponseError{Status: 405, Message: "Method not allowed", Code: "error.methodNotAllowed"}
+	errMissingURL       = aerrors.ResponseError{Status: 400, Message: "Missing parameter url", Code: "error.badRequest"}
+)
+
+func (h *BackendsHandle) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, h.Prefix), "/")
+	parts := strings.Split(path, "/")
+	backends := h.Manager.Backends()
+
+	if path == "" {
+		if req.Method != "GET" {
+			writeError(rw, errMethodNotAllowed)
+			return
+		}
+		writeResponse(rw, &responseJson{Data: backends, Status: 200})
+		return
+	}
+
+	service := parts[0]
+	if _, ok := backends[service]; !ok || len(parts) > 2 || (len(parts) == 2 && parts[1] != "drain") {
+		writeError(rw, errNotFound)
+		return
+	}
+
+	if req.Method == "GET" && len(parts) == 1 {
+		writeResponse(rw, &responseJson{Data: backends[service], Status: 200})
+		return
+	}
+
+	backendURL := req.FormValue("url")
+	var err error
+	switch {
+	case backendURL == "" && (req.Method == "POST" || req.Method == "DELETE"):
+		err = errMissingURL
+	case len(parts) == 2 && req.Method == "POST":
+		err = h.Manager.DrainBackend(service, backendURL)
+	case len(parts) == 1 && req.Method == "POST":
+		err = h.Manager.AddBackend(service, backendURL)
+	case len(parts) == 1 && req.Method == "DELETE":
+		err = h.Manager.RemoveBackend(service, backendURL)
+	default:
+		err = errMethodNotAllowed
+	}
+
+	if err != nil {
+		logger.Info("Can't change the backends of ", service, ": ", err.Error())
+		writeError(rw, err)
+		return
+	}
+	writeResponse(rw, &responseJson{Data: h.Manager.Backends()[service], Status: 200})
+}
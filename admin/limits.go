@@ -0,0 +1,27 @@
+package admin
+
+import (
+	"encoding/json"
+	"github.com/gigaroby/authproxy/limits"
+	"net/http"
+)
+
+// LimitsSource knows the current concurrency limits of the services.
+type LimitsSource interface {
+	ConcurrencyLimits() map[string]*limits.ConcurrencyStats
+}
+
+// LimitsHandle shows the concurrency limits of every service,
+// which change over time when they are adaptive.
+type LimitsHandle struct {
+	Source LimitsSource
+}
+
+func (h *LimitsHandle) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	res := &responseJson{Data: h.Source.ConcurrencyLimits(), Status: 200}
+	out, _ := json.Marshal(res)
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(res.Status)
+	rw.Write(out)
+}
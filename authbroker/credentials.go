@@ -0,0 +1,177 @@
+package authbroker
+
+import (
+	"encoding/base64"
+	"github.com/gigaroby/authproxy/ioextra"
+	"github.com/gigaroby/authproxy/requestid"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	appIdParam    = "$app_id"
+	appKeyParam   = "$app_key"
+	providerParam = "$provider"
+)
+
+// Credentials identify the application that is making a request.
+type Credentials struct {
+	AppId         string
+	AppKey        string
+	ProviderLabel string
+}
+
+// CredentialsParser finds the application credentials in an incoming request
+// and removes them, so that they are never forwarded to the backends.
+// Credentials are looked for, in order, in the configured headers, in the
+// Authorization header, in the query string and in form-encoded bodies:
+// the app id and key are both taken from the first source having either of them,
+// they are never mixed from different sources.
+// Bodies that are not form-encoded are never read nor modified.
+type CredentialsParser struct {
+	AppIdHeader    string
+	AppKeyHeader   string
+	ProviderHeader string
+	// Authorization schemes carrying credentials. The "Basic" scheme
+	// carries base64(app_id:app_key), any other scheme carries
+	// app_id:app_key in clear.
+	AuthSchemes []string
+}
+
+var DefaultCredentialsParser = &CredentialsParser{}
+
+func (c *Credentials) fill(appId, appKey, providerLabel string) {
+	if c.AppId == "" && c.AppKey == "" {
+		c.AppId, c.AppKey = appId, appKey
+	}
+	if c.ProviderLabel == "" {
+		c.ProviderLabel = providerLabel
+	}
+}
+
+// Parse extracts the credentials from req, removing them from the request.
+func (p *CredentialsParser) Parse(req *http.Request) (creds Credentials) {
+	creds.fill(p.popHeader(req, p.AppIdHeader), p.popHeader(req, p.AppKeyHeader), p.popHeader(req, p.ProviderHeader))
+	creds.fill(p.popAuthorization(req))
+	creds.fill(popQuery(req))
+	creds.fill(popForm(req))
+	return
+}
+
+func (p *CredentialsParser) popHeader(req *http.Request, name string) (value string) {
+	if name == "" {
+		return
+	}
+	value = req.Header.Get(name)
+	req.Header.Del(name)
+	return
+}
+
+func (p *CredentialsParser) popAuthorization(req *http.Request) (appId, appKey, providerLabel string) {
+	authorization := req.Header.Get("Authorization")
+	if authorization == "" {
+		return
+	}
+	fields := strings.SplitN(authorization, " ", 2)
+	if len(fields) != 2 {
+		return
+	}
+
+	for _, scheme := range p.AuthSchemes {
+		if !strings.EqualFold(scheme, fields[0]) {
+			continue
+		}
+
+		pair := strings.TrimSpace(fields[1])
+		if strings.EqualFold(scheme, "Basic") {
+			decoded, err := base64.StdEncoding.DecodeString(pair)
+			if err != nil {
+				logger.Infom("Invalid Basic authorization header", map[string]interface{}{
+					"request_id": requestid.FromContext(req.Context()),
+					"error":      err.Error(),
+				})
+				return
+			}
+			pair = string(decoded)
+		}
+
+		req.Header.Del("Authorization")
+		idAndKey := strings.SplitN(pair, ":", 2)
+		appId = idAndKey[0]
+		if len(idAndKey) == 2 {
+			appKey = idAndKey[1]
+		}
+		return
+	}
+	return
+}
+
+// popValues removes the credentials from values. It returns false if
+// values didn't contain any of them.
+func popValues(values url.Values) (appId, appKey, providerLabel string, found bool) {
+	for _, param := range []string{appIdParam, appKeyParam, providerParam} {
+		if _, ok := values[param]; ok {
+			found = true
+		}
+	}
+
+	appId = values.Get(appIdParam)
+	values.Del(appIdParam)
+	appKey = values.Get(appKeyParam)
+	values.Del(appKeyParam)
+	providerLabel = values.Get(providerParam)
+	values.Del(providerParam)
+	return
+}
+
+func popQuery(req *http.Request) (appId, appKey, providerLabel string) {
+	values := req.URL.Query()
+	appId, appKey, providerLabel, found := popValues(values)
+
+	// re-encoding the query changes the order of the parameters,
+	// so we only do it when needed
+	if found {
+		req.URL.RawQuery = values.Encode()
+	}
+	return
+}
+
+func isFormEncoded(req *http.Request) bool {
+	if req.Body == nil || req.Method == "GET" || req.Method == "HEAD" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/x-www-form-urlencoded"
+}
+
+func popForm(req *http.Request) (appId, appKey, providerLabel string) {
+	if !isFormEncoded(req) {
+		return
+	}
+
+	content, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.Infom("Error reading the request body", map[string]interface{}{
+			"request_id": requestid.FromContext(req.Context()),
+			"error":      err.Error(),
+		})
+	}
+
+	values, err := url.ParseQuery(string(content))
+	if err == nil {
+		var found bool
+		appId, appKey, providerLabel, found = popValues(values)
+		if found {
+			content = []byte(values.Encode())
+		}
+	}
+
+	req.Body = ioextra.NewBufferizedClosingReader(content)
+	req.ContentLength = int64(len(content))
+	req.PostForm = nil
+	req.Form = nil
+	return
+}
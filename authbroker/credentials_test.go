@@ -0,0 +1,124 @@
+package authbroker
+
+import (
+	"encoding/base64"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCredentialsParser(t *testing.T) {
+	parser := &CredentialsParser{
+		AppIdHeader:  "X-App-Id",
+		AppKeyHeader: "X-App-Key",
+		AuthSchemes:  []string{"Basic", "3scale"},
+	}
+
+	Convey("Given a parser configured with headers and Authorization schemes", t, func() {
+		Convey("When the credentials are in the headers", func() {
+			req, _ := http.NewRequest("GET", "http://example.com/datatxt/nex/v1/?text=1", nil)
+			req.Header.Set("X-App-Id", "MyApp")
+			req.Header.Set("X-App-Key", "MyKey")
+			creds := parser.Parse(req)
+
+			Convey("Then they are read and removed from the request", func() {
+				So(creds.AppId, ShouldEqual, "MyApp")
+				So(creds.AppKey, ShouldEqual, "MyKey")
+				So(req.Header.Get("X-App-Id"), ShouldEqual, "")
+				So(req.Header.Get("X-App-Key"), ShouldEqual, "")
+			})
+			Convey("Then the query is not rewritten", func() {
+				So(req.URL.RawQuery, ShouldEqual, "text=1")
+			})
+		})
+
+		Convey("When the credentials are in a Basic Authorization header", func() {
+			req, _ := http.NewRequest("GET", "http://example.com/datatxt/nex/v1/", nil)
+			req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("MyApp:MyKey")))
+			creds := parser.Parse(req)
+
+			Convey("Then they are read and removed from the request", func() {
+				So(creds.AppId, ShouldEqual, "MyApp")
+				So(creds.AppKey, ShouldEqual, "MyKey")
+				So(req.Header.Get("Authorization"), ShouldEqual, "")
+			})
+		})
+
+		Convey("When the Authorization header uses a custom scheme", func() {
+			req, _ := http.NewRequest("GET", "http://example.com/datatxt/nex/v1/", nil)
+			req.Header.Set("Authorization", "3scale MyApp:MyKey")
+			creds := parser.Parse(req)
+
+			So(creds.AppId, ShouldEqual, "MyApp")
+			So(creds.AppKey, ShouldEqual, "MyKey")
+		})
+
+		Convey("When the app id and the app key are in different places", func() {
+			req, _ := http.NewRequest("GET", "http://example.com/datatxt/nex/v1/?$app_key=OtherKey", nil)
+			req.Header.Set("X-App-Id", "MyApp")
+			creds := parser.Parse(req)
+
+			Convey("Then they are not mixed, but both removed", func() {
+				So(creds.AppId, ShouldEqual, "MyApp")
+				So(creds.AppKey, ShouldEqual, "")
+				So(req.URL.RawQuery, ShouldEqual, "")
+			})
+		})
+
+		Convey("When the Authorization header uses an unknown scheme", func() {
+			req, _ := http.NewRequest("GET", "http://example.com/datatxt/nex/v1/", nil)
+			req.Header.Set("Authorization", "Bearer something")
+			creds := parser.Parse(req)
+
+			Convey("Then it is left untouched", func() {
+				So(creds.AppId, ShouldEqual, "")
+				So(req.Header.Get("Authorization"), ShouldEqual, "Bearer something")
+			})
+		})
+
+		Convey("When a POST request has the credentials in the query", func() {
+			body := `{"text": "$app_id"}`
+			req, _ := http.NewRequest("POST", "http://example.com/datatxt/nex/v1/?$app_id=MyApp&$app_key=MyKey", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			creds := parser.Parse(req)
+
+			Convey("Then they are read from the query", func() {
+				So(creds.AppId, ShouldEqual, "MyApp")
+				So(creds.AppKey, ShouldEqual, "MyKey")
+				So(req.URL.RawQuery, ShouldEqual, "")
+			})
+			Convey("Then the JSON body is left untouched", func() {
+				content, _ := ioutil.ReadAll(req.Body)
+				So(string(content), ShouldEqual, body)
+			})
+		})
+
+		Convey("When a form-encoded body doesn't contain credentials", func() {
+			body := "b=2&a=1"
+			req, _ := http.NewRequest("POST", "http://example.com/datatxt/nex/v1/", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+			req.Header.Set("X-App-Id", "MyApp")
+			parser.Parse(req)
+
+			Convey("Then the body is left byte-for-byte untouched", func() {
+				content, _ := ioutil.ReadAll(req.Body)
+				So(string(content), ShouldEqual, body)
+			})
+		})
+
+		Convey("When the credentials are in a multipart body", func() {
+			body := "--xxx\r\nContent-Disposition: form-data; name=\"$app_id\"\r\n\r\nMyApp\r\n--xxx--\r\n"
+			req, _ := http.NewRequest("POST", "http://example.com/datatxt/nex/v1/", strings.NewReader(body))
+			req.Header.Set("Content-Type", "multipart/form-data; boundary=xxx")
+			creds := parser.Parse(req)
+
+			Convey("Then the body is not read", func() {
+				So(creds.AppId, ShouldEqual, "")
+				content, _ := ioutil.ReadAll(req.Body)
+				So(string(content), ShouldEqual, body)
+			})
+		})
+	})
+}
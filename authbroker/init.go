@@ -7,7 +7,8 @@ import (
 )
 
 const (
-	creditsHeader      = "X-DL-units"
+	// CreditsHeader tells how many credits a response costs.
+	CreditsHeader      = "X-DL-units"
 	creditsLeftHeader  = "X-DL-units-left"
 	creditsResetHeader = "X-DL-units-reset"
 )
@@ -27,7 +28,18 @@ type AuthenticationBroker interface {
 }
 
 // YesBroker is to be used for debug only.
-type YesBroker struct{}
+type YesBroker struct {
+	// Credentials finds the app_id in the requests for the quota.
+	// When nil, DefaultCredentialsParser is used.
+	Credentials *CredentialsParser
+}
+
+func (y *YesBroker) credentialsParser() *CredentialsParser {
+	if y.Credentials == nil {
+		return DefaultCredentialsParser
+	}
+	return y.Credentials
+}
 
 func (y *YesBroker) Authenticate(req *http.Request) (toProxy bool, msg BrokerMessage, err *aerrors.ResponseError) {
 	toProxy = true
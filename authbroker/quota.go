@@ -0,0 +1,45 @@
+package authbroker
+
+import (
+	"github.com/gigaroby/authproxy/aerrors"
+	"net/http"
+	"time"
+)
+
+// Quota is what an application used, and can still use, of its plan.
+type Quota struct {
+	AppId string `json:"appId"`
+	Plan  string `json:"plan,omitempty"`
+	// Unlimited is true when the plan has no limits, Usage is empty then.
+	Unlimited bool          `json:"unlimited"`
+	Usage     []MetricUsage `json:"usage"`
+}
+
+// MetricUsage is the usage of a metric in the current period, in credits.
+type MetricUsage struct {
+	Metric      string     `json:"metric"`
+	Period      string     `json:"period"`
+	Max         float64    `json:"max"`
+	Current     float64    `json:"current"`
+	Left        float64    `json:"left"`
+	PeriodStart *time.Time `json:"periodStart,omitempty"`
+	PeriodEnd   *time.Time `json:"periodEnd,omitempty"`
+}
+
+// QuotaBroker is implemented by the brokers that know the quota of the applications.
+type QuotaBroker interface {
+	// Quota looks up the quota of the application whose credentials are in req,
+	// without using any of it.
+	Quota(req *http.Request) (*Quota, *aerrors.ResponseError)
+}
+
+var errMissingAppId = &aerrors.ResponseError{Message: "Missing parameter $app_id", Status: 400, Code: "error.missingParameter"}
+
+// The YesBroker has no limits.
+func (y *YesBroker) Quota(req *http.Request) (*Quota, *aerrors.ResponseError) {
+	creds := y.credentialsParser().Parse(req)
+	if creds.AppId == "" {
+		return nil, errMissingAppId
+	}
+	return &Quota{AppId: creds.AppId, Unlimited: true, Usage: []MetricUsage{}}, nil
+}
@@ -2,25 +2,41 @@ package authbroker
 
 import (
 	"bytes"
+	"context"
 	"encoding/xml"
 	"fmt"
 	"github.com/gigaroby/authproxy/aerrors"
-	"github.com/gigaroby/authproxy/ioextra"
+	"github.com/gigaroby/authproxy/metrics"
+	"github.com/gigaroby/authproxy/requestid"
+	"github.com/gigaroby/authproxy/tracing"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
 	ThreeScaleHitsMultiplier = 1e6
+	// how long a report to 3scale can take
+	reportTimeout = 30 * time.Second
+)
+
+var (
+	reportQueueDepth = metrics.NewGaugeVec("authproxy_threescale_report_queue_depth",
+		"Reports to 3scale waiting to be sent.")
+	reportFailures = metrics.NewCounterVec("authproxy_threescale_report_failures_total",
+		"Reports to 3scale that could not be sent.")
 )
 
 // 3scale broker http://3scale.net
 type ThreeScaleBroker struct {
 	ProviderKey             string
 	ProviderKeyAlternatives map[string]string
-	client                  *http.Client
+	// Credentials finds app_id, app_key and provider in the requests.
+	// When nil, DefaultCredentialsParser is used.
+	Credentials *CredentialsParser
+	client      *http.Client
 }
 
 type ThreeXMLUsageReport struct {
@@ -53,43 +69,11 @@ func NewThreeScaleBroker(provKey string, provKeyAlts map[string]string, transpor
 	return &ThreeScaleBroker{ProviderKey: provKey, ProviderKeyAlternatives: provKeyAlts, client: &http.Client{Transport: transport}}
 }
 
-func parseRequestForApp(req *http.Request) (appId, appKey, providerLabel string) {
-	switch req.Method {
-	case "GET":
-		{
-			values := req.URL.Query()
-
-			appId = values.Get("$app_id")
-			values.Del("$app_id")
-			appKey = values.Get("$app_key")
-			values.Del("$app_key")
-			providerLabel = values.Get("$provider")
-			values.Del("$provider")
-
-			req.URL.RawQuery = values.Encode()
-		}
-	default: // POST or PUT
-		{
-			req.ParseForm()
-			values := req.PostForm
-
-			appId = values.Get("$app_id")
-			values.Del("$app_id")
-			appKey = values.Get("$app_key")
-			values.Del("$app_key")
-			providerLabel = values.Get("$provider")
-			values.Del("$provider")
-
-			content := []byte(values.Encode())
-			req.Body = ioextra.NewBufferizedClosingReader(content)
-			req.PostForm = nil
-			req.Form = nil
-			req.ContentLength = int64(len(content))
-			req.ParseForm()
-		}
+func (brk *ThreeScaleBroker) credentialsParser() *CredentialsParser {
+	if brk.Credentials == nil {
+		return DefaultCredentialsParser
 	}
-
-	return
+	return brk.Credentials
 }
 
 func (brk *ThreeScaleBroker) getProviderKey(label string) (providerKey string) {
@@ -101,6 +85,16 @@ func (brk *ThreeScaleBroker) getProviderKey(label string) (providerKey string) {
 }
 
 func (brk *ThreeScaleBroker) DoAuthenticate(appId, appKey, providerLabel, methodName string) (status ThreeXMLStatus, msg map[string]string, err *aerrors.ResponseError) {
+	return brk.authorize(context.Background(), appId, appKey, providerLabel, methodName)
+}
+
+// authorize calls 3scale as part of the trace in ctx.
+func (brk *ThreeScaleBroker) authorize(ctx context.Context, appId, appKey, providerLabel, methodName string) (status ThreeXMLStatus, msg map[string]string, err *aerrors.ResponseError) {
+	ctx, span := tracing.StartSpan(ctx, "3scale authorize", tracing.KindClient)
+	defer span.Finish()
+	span.SetAttribute("app_id", appId)
+	requestId := requestid.FromContext(ctx)
+
 	values := url.Values{}
 
 	providerKey := brk.getProviderKey(providerLabel)
@@ -115,16 +109,24 @@ func (brk *ThreeScaleBroker) DoAuthenticate(appId, appKey, providerLabel, method
 	msg = map[string]string{
 		"appId":       appId,
 		"providerKey": providerKey,
+		"provider":    providerLabel,
 		"method":      methodName,
+		"requestId":   requestId,
 	}
 
 	authReq, _ := http.NewRequest("GET", "https://su1.3scale.net/transactions/authorize.xml", nil)
 	authReq.URL.RawQuery = values.Encode()
+	authReq = authReq.WithContext(ctx)
+	tracing.Inject(span.Context, authReq.Header)
+	if requestId != "" {
+		authReq.Header.Set(requestid.Header, requestId)
+	}
 
 	authRes, err_ := brk.client.Do(authReq)
 	if err_ != nil {
 		//TODO[vad]: report 3scale's down
-		logger.Error("Error connecting to 3scale: ", err_.Error())
+		logger.Errorm("Error connecting to 3scale", map[string]interface{}{"error": err_.Error(), "request_id": requestId})
+		span.SetError(err_.Error())
 		err = &aerrors.ResponseError{Message: "Internal server error", Status: 500, Code: "error.internalServerError"}
 		return
 	}
@@ -136,23 +138,27 @@ func (brk *ThreeScaleBroker) DoAuthenticate(appId, appKey, providerLabel, method
 	xml.Unmarshal(buf.Bytes(), &status)
 
 	if status.XMLName.Local == "error" {
+		span.SetError(status.Data)
 		err = &aerrors.ResponseError{Message: status.Data, Status: 401, Code: "error.authenticationError"}
 		return
 	}
+	span.SetAttribute("authorized", status.Authorized)
 
 	// find the report we want to show to the user and put it in "report"
 	var report *ThreeXMLUsageReport
 	for _, usageReport := range status.UsageReports {
 		if usageReport.Metric == "hits" {
 			if report != nil {
-				logger.Warning("Report for `hits' found multiple times for app_id ", appId)
+				logger.Warningm("Report for `hits' found multiple times", map[string]interface{}{"app_id": appId, "request_id": requestId})
 			}
 			report = usageReport
 		}
 	}
 
+	msg["plan"] = status.Plan
+
 	if report == nil {
-		logger.Warning("Missing usage reports for app_id ", appId)
+		logger.Warningm("Missing usage reports", map[string]interface{}{"app_id": appId, "request_id": requestId})
 	} else {
 		msg["creditsLeft"] = strconv.Itoa(report.MaxValue - report.CurrentValue)
 		msg["creditsReset"] = report.PeriodEnd
@@ -162,16 +168,16 @@ func (brk *ThreeScaleBroker) DoAuthenticate(appId, appKey, providerLabel, method
 }
 
 func (brk *ThreeScaleBroker) Authenticate(req *http.Request) (toProxy bool, msg BrokerMessage, err *aerrors.ResponseError) {
-	appId, appKey, providerLabel := parseRequestForApp(req)
+	creds := brk.credentialsParser().Parse(req)
 
-	if appKey == "" || appId == "" {
+	if creds.AppKey == "" || creds.AppId == "" {
 		err = &aerrors.ResponseError{Message: "missing parameters $app_id and/or $app_key",
 			Status: 401, Code: "error.missingParameter"}
 		return
 	}
 	metricName := strings.Trim(req.URL.Path, "/")
 
-	status, msg, err := brk.DoAuthenticate(appId, appKey, providerLabel, metricName)
+	status, msg, err := brk.authorize(req.Context(), creds.AppId, creds.AppKey, creds.ProviderLabel, metricName)
 
 	if err != nil {
 		return
@@ -183,6 +189,49 @@ func (brk *ThreeScaleBroker) Authenticate(req *http.Request) (toProxy bool, msg
 	return
 }
 
+// 3scale periods look like "2013-10-01 00:00:00 +0000"
+const threeScaleTimeLayout = "2006-01-02 15:04:05 -0700"
+
+func parseThreeScaleTime(value string) *time.Time {
+	t, err := time.Parse(threeScaleTimeLayout, value)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// Quota asks 3scale for the usage reports of the application, without reporting any hit.
+// Applications with no usage reports have an unlimited plan.
+func (brk *ThreeScaleBroker) Quota(req *http.Request) (quota *Quota, err *aerrors.ResponseError) {
+	creds := brk.credentialsParser().Parse(req)
+	if creds.AppId == "" {
+		return nil, errMissingAppId
+	}
+
+	status, _, err := brk.authorize(req.Context(), creds.AppId, creds.AppKey, creds.ProviderLabel, "")
+	if err != nil {
+		return
+	}
+	if !status.Authorized && len(status.UsageReports) == 0 {
+		return nil, &aerrors.ResponseError{Message: status.Reason, Status: 401, Code: "error.authenticationError"}
+	}
+
+	quota = &Quota{AppId: creds.AppId, Plan: status.Plan, Usage: []MetricUsage{}}
+	quota.Unlimited = len(status.UsageReports) == 0
+	for _, report := range status.UsageReports {
+		quota.Usage = append(quota.Usage, MetricUsage{
+			Metric:      report.Metric,
+			Period:      report.Period,
+			Max:         float64(report.MaxValue) / ThreeScaleHitsMultiplier,
+			Current:     float64(report.CurrentValue) / ThreeScaleHitsMultiplier,
+			Left:        float64(report.MaxValue-report.CurrentValue) / ThreeScaleHitsMultiplier,
+			PeriodStart: parseThreeScaleTime(report.PeriodStart),
+			PeriodEnd:   parseThreeScaleTime(report.PeriodEnd),
+		})
+	}
+	return
+}
+
 func round(f float64) int {
 	return int(f + 0.5)
 }
@@ -190,19 +239,20 @@ func round(f float64) int {
 func (brk *ThreeScaleBroker) Report(res *http.Response, msg BrokerMessage) (wait chan bool, err error) {
 	wait = make(chan bool, 1)
 	appId := msg["appId"]
-	creditsHeaderValue := res.Header.Get(creditsHeader)
+	requestId := msg["requestId"]
+	creditsHeaderValue := res.Header.Get(CreditsHeader)
 	credits, creditsErr := strconv.ParseFloat(creditsHeaderValue, 64)
 
 	if creditsErr != nil {
 		if res.Request != nil {
-			logger.Info("The response from ", res.Request.URL.String(), " does not contain ", creditsHeader)
+			logger.Infom("The response does not contain "+CreditsHeader, map[string]interface{}{"url": res.Request.URL.String(), "request_id": requestId})
 		}
 		credits = 1.0
-		res.Header[creditsHeader] = []string{"1"}
+		res.Header[CreditsHeader] = []string{"1"}
 	} else {
 		// this is an hack: rewrite X-Dl-Units -> X-DL-units
-		res.Header.Del(creditsHeader)
-		res.Header[creditsHeader] = []string{creditsHeaderValue}
+		res.Header.Del(CreditsHeader)
+		res.Header[CreditsHeader] = []string{creditsHeaderValue}
 	}
 	hits := round(credits * ThreeScaleHitsMultiplier)
 
@@ -220,7 +270,7 @@ func (brk *ThreeScaleBroker) Report(res *http.Response, msg BrokerMessage) (wait
 		metric = "hits"
 	}
 	transactionMetric := fmt.Sprintf("transactions[0][usage][%s]", metric)
-	logger.Infof("Reporting %d hits for metric '%s'", hits, transactionMetric)
+	logger.Infom("Reporting hits", map[string]interface{}{"hits": hits, "metric": transactionMetric, "request_id": requestId})
 
 	values := url.Values{
 		"provider_key":            {msg["providerKey"]},
@@ -228,10 +278,41 @@ func (brk *ThreeScaleBroker) Report(res *http.Response, msg BrokerMessage) (wait
 		transactionMetric:         {strconv.Itoa(hits)},
 	}
 
+	ctx := context.Background()
+	if res.Request != nil {
+		ctx = res.Request.Context()
+	}
+	_, span := tracing.StartSpan(ctx, "3scale report", tracing.KindClient)
+	span.SetAttribute("app_id", appId)
+	span.SetAttribute("hits", hits)
+	// the request is over before the report is sent: only the trace goes on
+	ctx, cancel := context.WithTimeout(tracing.ContextWithSpan(context.Background(), span), reportTimeout)
+
+	reportReq, _ := http.NewRequest("POST", "https://su1.3scale.net/transactions.xml", strings.NewReader(values.Encode()))
+	reportReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	reportReq = reportReq.WithContext(ctx)
+	tracing.Inject(span.Context, reportReq.Header)
+	if requestId != "" {
+		reportReq.Header.Set(requestid.Header, requestId)
+	}
+
+	reportQueueDepth.Add(1)
 	go func() {
-		_, err := brk.client.PostForm("https://su1.3scale.net/transactions.xml", values)
+		defer reportQueueDepth.Add(-1)
+		defer span.Finish()
+		defer cancel()
+		reportRes, err := brk.client.Do(reportReq)
 		if err != nil {
-			logger.Warningf("Error reporting %d hits for app %s", hits, appId)
+			reportFailures.Inc()
+			span.SetError(err.Error())
+			logger.Warningm("Error reporting hits", map[string]interface{}{"hits": hits, "app_id": appId, "error": err.Error(), "request_id": requestId})
+		} else {
+			reportRes.Body.Close()
+			if reportRes.StatusCode > 299 {
+				reportFailures.Inc()
+				span.SetError(reportRes.Status)
+				logger.Warningm("3scale refused the report", map[string]interface{}{"hits": hits, "app_id": appId, "status": reportRes.Status, "request_id": requestId})
+			}
 		}
 		wait <- true
 	}()
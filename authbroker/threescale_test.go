@@ -1,6 +1,7 @@
 package authbroker
 
 import (
+	"context"
 	. "github.com/gigaroby/authproxy/testutils"
 	. "github.com/smartystreets/goconvey/convey"
 	"io/ioutil"
@@ -276,3 +277,112 @@ func TestThreeScaleBrokerReportWorks(t *testing.T) {
 		})
 	})
 }
+
+func TestThreeScaleBrokerQuota(t *testing.T) {
+	body :=
+		`<?xml version="1.0" encoding="UTF-8"?>
+        <status>
+            <authorized>true</authorized>
+            <plan>Default</plan>
+            <usage_reports>
+                <usage_report metric="hits" period="day">
+                    <period_start>2013-10-01 00:00:00 +0000</period_start>
+                    <period_end>2013-10-02 00:00:00 +0000</period_end>
+                    <max_value>20000000</max_value>
+                    <current_value>5000000</current_value>
+                </usage_report>
+              </usage_reports>
+        </status>`
+	unlimited :=
+		`<?xml version="1.0" encoding="UTF-8"?>
+        <status>
+            <authorized>true</authorized>
+            <plan>Unlimited</plan>
+        </status>`
+
+	Convey("Given a user asking for his quota", t, func() {
+		Convey("When he sends his app id in a header", func() {
+			broker := noProviderBroker(&FactoryTransport{Response: NewResponse(200, body)})
+			broker.Credentials = &CredentialsParser{AppIdHeader: "X-App-Id"}
+			req, _ := http.NewRequest("GET", "http://example.com/admin/credits", nil)
+			req.Header.Set("X-App-Id", "MyApp")
+			quota, err := broker.Quota(req)
+
+			Convey("He gets the usage of every metric in credits", func() {
+				So(err, ShouldBeNil)
+				So(quota.AppId, ShouldEqual, "MyApp")
+				So(quota.Unlimited, ShouldBeFalse)
+				So(quota.Usage, ShouldHaveLength, 1)
+				So(quota.Usage[0].Left, ShouldEqual, 15)
+				So(quota.Usage[0].Current, ShouldEqual, 5)
+				So(quota.Usage[0].PeriodEnd.Day(), ShouldEqual, 2)
+			})
+		})
+
+		Convey("When his plan has no limits", func() {
+			broker := noProviderBroker(&FactoryTransport{Response: NewResponse(200, unlimited)})
+			req, _ := http.NewRequest("GET", "http://example.com/admin/credits?$app_id=MyApp", nil)
+			quota, err := broker.Quota(req)
+
+			Convey("His quota is unlimited", func() {
+				So(err, ShouldBeNil)
+				So(quota.Unlimited, ShouldBeTrue)
+				So(quota.Plan, ShouldEqual, "Unlimited")
+			})
+		})
+
+		Convey("When he doesn't send his app id", func() {
+			broker := noProviderBroker(&FactoryTransport{Response: NewResponse(200, body)})
+			req, _ := http.NewRequest("GET", "http://example.com/admin/credits", nil)
+			_, err := broker.Quota(req)
+
+			Convey("He gets an error", func() {
+				So(err.Status, ShouldEqual, 400)
+			})
+		})
+	})
+}
+
+func TestYesBrokerQuota(t *testing.T) {
+	Convey("Given a debug broker reading the app id from a header", t, func() {
+		broker := &YesBroker{Credentials: &CredentialsParser{AppIdHeader: "X-App-Id"}}
+		req, _ := http.NewRequest("GET", "http://example.com/admin/credits", nil)
+		req.Header.Set("X-App-Id", "MyApp")
+		quota, err := broker.Quota(req)
+
+		Convey("The quota is the one of the app in the header", func() {
+			So(err, ShouldBeNil)
+			So(quota.AppId, ShouldEqual, "MyApp")
+			So(quota.Unlimited, ShouldBeTrue)
+		})
+	})
+}
+
+// a http.RoundTripper failing the requests whose context is done
+type contextTransport struct {
+	RecordTransport
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+	return t.RecordTransport.RoundTrip(req)
+}
+
+func TestThreeScaleBrokerReportAfterRequest(t *testing.T) {
+	Convey("Given a client request that is over before the report is sent", t, func() {
+		transport := &contextTransport{}
+		broker := noProviderBroker(transport)
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequest("GET", "http://localhost/service1", nil)
+		res := NewResponse(200, "")
+		res.Request = req.WithContext(ctx)
+		cancel()
+
+		wait, _ := broker.Report(res, BrokerMessage{"appId": "MyApp"})
+		<-wait
+
+		So(transport.LastRequest, ShouldNotBeNil)
+	})
+}
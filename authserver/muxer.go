@@ -1,19 +1,21 @@
 package authserver
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/gigaroby/authproxy/admin"
 	"github.com/gigaroby/authproxy/authbroker"
 	"github.com/gigaroby/authproxy/ioextra"
+	"github.com/gigaroby/authproxy/metrics"
+	"github.com/gigaroby/authproxy/requestid"
+	"github.com/gigaroby/authproxy/tracing"
 	log "github.com/gigaroby/gopherlog"
-	"io"
 	"net/http"
 	"net/http/pprof"
 )
 
 const (
+	// the services have their own limits, this is for everything else
 	requestMaxSize = 1 << 20 // 1MB
 )
 
@@ -31,21 +33,65 @@ func status(rw http.ResponseWriter, req *http.Request) {
 }
 
 type responseJson struct {
-	Error   bool   `json:"error"`
-	Message string `json:"message"`
-	Code    string `json:"code,omitempty"`
-	Status  int    `json:"status"`
+	Error     bool   `json:"error"`
+	Message   string `json:"message"`
+	Code      string `json:"code,omitempty"`
+	Status    int    `json:"status"`
+	RequestId string `json:"requestId,omitempty"`
 }
 
-func NewHandle(broker authbroker.AuthenticationBroker, proxyHandler http.Handler, adminPath string, profiler bool) *Handle {
+// ServiceMatcher tells if a request goes to a service, which limits its body on its own.
+type ServiceMatcher interface {
+	MatchService(req *http.Request) bool
+}
+
+// limitBody buffers the bodies of the requests to handler, refusing the ones bigger
+// than requestMaxSize, unless they go to a service.
+func limitBody(handler http.Handler) http.Handler {
+	matcher, _ := handler.(ServiceMatcher)
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if matcher != nil && matcher.MatchService(req) {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		body, err := ioextra.LimitAndBufferBody(rw, req.Body, requestMaxSize)
+		if err != nil {
+			requestId := requestid.FromContext(req.Context())
+			logger.Infom(err.Error(), map[string]interface{}{"request_id": requestId})
+			rw.WriteHeader(400)
+			res, _ := json.Marshal(&responseJson{Status: 400, Message: "Request too large", Code: "error.requestTooLarge", RequestId: requestId})
+			rw.Write(res)
+			return
+		}
+		req.Body = body
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// NewAdminHandle serves the admin endpoints below /adminPath/
+// and, when profiler is true, the profiler below /debug/pprof.
+func NewAdminHandle(broker authbroker.AuthenticationBroker, proxyHandler http.Handler, adminPath string, profiler bool) http.Handler {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/status", status)
 
-	if tBroker, ok := broker.(*authbroker.ThreeScaleBroker); ok {
-		creditsHandler := &admin.CreditsHandle{Broker: tBroker}
+	if qBroker, ok := broker.(authbroker.QuotaBroker); ok {
+		creditsHandler := &admin.CreditsHandle{Broker: qBroker}
 		mux.Handle(fmt.Sprintf("/%s/credits", adminPath), creditsHandler)
 	}
 
+	mux.Handle(fmt.Sprintf("/%s/metrics", adminPath), metrics.Handler())
+
+	if source, ok := proxyHandler.(admin.LimitsSource); ok {
+		mux.Handle(fmt.Sprintf("/%s/limits", adminPath), &admin.LimitsHandle{Source: source})
+	}
+
+	if manager, ok := proxyHandler.(admin.BackendsManager); ok {
+		prefix := fmt.Sprintf("/%s/backends", adminPath)
+		backendsHandler := &admin.BackendsHandle{Manager: manager, Prefix: prefix}
+		mux.Handle(prefix, backendsHandler)
+		mux.Handle(prefix+"/", backendsHandler)
+	}
+
 	if profiler {
 		mux.HandleFunc("/debug/pprof", pprof.Index)
 		mux.Handle("/debug/pprof/heap", pprof.Handler("heap"))
@@ -55,40 +101,48 @@ func NewHandle(broker authbroker.AuthenticationBroker, proxyHandler http.Handler
 		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 	}
 
-	mux.Handle("/", proxyHandler)
-
-	return &Handle{mux: mux}
+	return limitBody(mux)
 }
 
-func limitAndBufferBody(rw http.ResponseWriter, body io.ReadCloser, requestMaxSize int64) (rc io.ReadCloser, err error) {
-	var buffer bytes.Buffer
-
-	// limit the request Body and buffer it
-	_, err = buffer.ReadFrom(http.MaxBytesReader(rw, body, requestMaxSize))
+// NewHandle serves the proxy. When adminHandler is not nil it gets the requests
+// below /adminPath/ and /debug/pprof, otherwise they are served on another listener.
+func NewHandle(proxyHandler, adminHandler http.Handler, adminPath string) *Handle {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", status)
 
-	if err != nil {
-		return
+	if adminHandler != nil {
+		mux.Handle(fmt.Sprintf("/%s/", adminPath), adminHandler)
+		mux.Handle("/debug/pprof", adminHandler)
+		mux.Handle("/debug/pprof/", adminHandler)
 	}
 
-	// we can't use NopCloser here, because we need to Seek after.
-	// ClosingReader (with its anonymous field) allows to do it
-	rc = ioextra.NewBufferizedClosingReader(buffer.Bytes())
-	return
+	// the requests to no service get the 404 of the proxy
+	mux.Handle("/", limitBody(proxyHandler))
+
+	return &Handle{mux: mux}
 }
 
-func (h *Handle) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+func (h *Handle) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 
-	body, err := limitAndBufferBody(rw, req.Body, requestMaxSize)
-	req.Body = body
-
-	if err != nil {
-		logger.Info(err.Error())
-		rw.WriteHeader(400)
-		res, _ := json.Marshal(&responseJson{Status: 400, Message: "Request too large", Code: "error.requestTooLarge"})
-		rw.Write(res)
-		return
-	}
+	req, requestId := requestid.Ensure(req)
+	w.Header().Set(requestid.Header, requestId)
+
+	ctx, span := tracing.DefaultTracer.StartRemoteSpan(req.Context(), "authproxy.request", tracing.KindServer, req.Header)
+	span.SetAttribute("request_id", requestId)
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.target", req.URL.Path)
+	span.SetAttribute("net.peer.address", req.RemoteAddr)
+	req = req.WithContext(ctx)
+
+	rw := ioextra.NewResponseWriter(w)
+	defer func() {
+		span.SetAttribute("http.status_code", rw.Status)
+		if rw.Status > 499 {
+			span.SetError(http.StatusText(rw.Status))
+		}
+		span.Finish()
+	}()
 
 	h.mux.ServeHTTP(rw, req)
 }
@@ -2,70 +2,48 @@ package authserver
 
 import (
 	"bytes"
-	"io"
 	"io/ioutil"
-	// "net/http"
+	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
 )
 
-const (
-	input = `
-	       Besame, besame mucho,
-	       Como si fuera esta noche la última vez,
-	       Besame, besame mucho,
-	       Que tengo miedo a perderte, perderte despues`
-)
+// a proxy with a single service below /service
+type fakeProxy struct{}
 
-func TestLimitAndBufferBodyDoesWork(t *testing.T) {
-	rw := httptest.NewRecorder()
-	body := ioutil.NopCloser(bytes.NewReader([]byte(input)))
+func (p fakeProxy) MatchService(req *http.Request) bool {
+	return strings.HasPrefix(req.URL.Path, "/service")
+}
 
-	out, err := limitAndBufferBody(rw, body, 1000)
+func (p fakeProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	content, _ := ioutil.ReadAll(req.Body)
+	rw.Write([]byte(strconv.Itoa(len(content))))
+}
 
-	if err != nil {
-		t.Error("Short text, high limit: should work, but it doesn't!")
+func TestHandleLimitsBodies(t *testing.T) {
+	admin := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		content, _ := ioutil.ReadAll(req.Body)
+		rw.Write([]byte(strconv.Itoa(len(content))))
+	})
+	h := NewHandle(fakeProxy{}, limitBody(admin), "admin")
+	big := bytes.Repeat([]byte("a"), requestMaxSize+1)
+
+	send := func(path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "http://localhost"+path, bytes.NewReader(big))
+		h.ServeHTTP(rw, req)
+		return rw
 	}
 
-	read := make([]byte, len(input))
-	out.Read(read)
-
-	if string(read) != input {
-		t.Error("Body corrupted by limitAndBufferBody. Expected:", input, "\nGot: ", string(read))
+	if rw := send("/admin/backends"); rw.Code != 400 || !strings.Contains(rw.Body.String(), "error.requestTooLarge") {
+		t.Error("The admin endpoints should refuse big bodies, got", rw.Code, rw.Body.String())
 	}
-
-	seeker, ok := out.(io.ReadSeeker)
-	if !ok {
-		t.Error("It should return a ReadSeeker")
+	if rw := send("/unknown"); rw.Code != 400 {
+		t.Error("The requests to no service should refuse big bodies, got", rw.Code)
 	}
-	seeker.Seek(0, 0)
-
-	readAfterSeek := make([]byte, len(input))
-	seeker.Read(readAfterSeek)
-
-	if string(readAfterSeek) != input {
-		t.Error("Seek() does not work as expected. Should be:", input, "\nGot: ", string(read))
+	if rw := send("/service/v1"); rw.Code != 200 || rw.Body.String() != strconv.Itoa(len(big)) {
+		t.Error("The services should get the whole body, got", rw.Code, rw.Body.String())
 	}
 }
-
-func TestLimitAndBufferBodyDoesLimit(t *testing.T) {
-	rw := httptest.NewRecorder()
-	body := ioutil.NopCloser(bytes.NewReader([]byte(input)))
-
-	_, err := limitAndBufferBody(rw, body, 20)
-
-	if err == nil {
-		t.Error("Limit is not working")
-	}
-}
-
-// func TestLimitAndBufferCanSeek(t *testing.T) {
-// 	rw := httptest.NewRecorder()
-// 	body := ioutil.NopCloser(bytes.NewReader([]byte(input)))
-
-// 	out, err := limitAndBufferBody(rw, body, 1000)
-
-// 	if err != nil {
-// 		t.Error("Limit is not working")
-// 	}
-// }
@@ -0,0 +1,182 @@
+// Identity tells the backends which application made a request, with headers
+// signed by the proxy so that they can be trusted without authenticating again.
+//
+// With the HMAC signer the identity is sent in the X-Authproxy-* headers, signed in
+// X-Authproxy-Signature; with the JWT signer it is a short-lived HS256 token
+// in X-Authproxy-Identity. Verify and VerifyJWT check them on the backends.
+package identity
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// HeaderPrefix is the prefix of all the identity headers. The proxy removes
+	// the headers with this prefix sent by the clients.
+	HeaderPrefix = "X-Authproxy-"
+
+	AppIdHeader     = HeaderPrefix + "App-Id"
+	PlanHeader      = HeaderPrefix + "Plan"
+	ProviderHeader  = HeaderPrefix + "Provider"
+	ScopesHeader    = HeaderPrefix + "Scopes"
+	TimestampHeader = HeaderPrefix + "Timestamp"
+	SignatureHeader = HeaderPrefix + "Signature"
+	TokenHeader     = HeaderPrefix + "Identity"
+)
+
+var (
+	ErrMissing   = errors.New("identity: missing")
+	ErrSignature = errors.New("identity: invalid signature")
+	ErrExpired   = errors.New("identity: expired")
+)
+
+// Identity is the application that made a request.
+type Identity struct {
+	AppId    string   `json:"sub"`
+	Plan     string   `json:"plan,omitempty"`
+	Provider string   `json:"provider,omitempty"`
+	Scopes   []string `json:"scopes,omitempty"`
+}
+
+// A Signer adds the identity to the headers of a request for a backend.
+type Signer interface {
+	Sign(id *Identity, req *http.Request)
+}
+
+// Strip removes the identity headers, which only the proxy can send.
+func Strip(header http.Header) {
+	for k := range header {
+		if strings.HasPrefix(http.CanonicalHeaderKey(k), HeaderPrefix) {
+			delete(header, k)
+		}
+	}
+}
+
+// HMACSigner sends the identity in clear, with an HMAC-SHA256 of it,
+// of the time and of the method and path of the request.
+type HMACSigner struct {
+	Key []byte
+}
+
+func signature(key []byte, id *Identity, timestamp, method, path string) string {
+	mac := hmac.New(sha256.New, key)
+	for _, part := range []string{id.AppId, id.Plan, id.Provider, strings.Join(id.Scopes, ","), timestamp, method, path} {
+		mac.Write([]byte(part))
+		mac.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *HMACSigner) Sign(id *Identity, req *http.Request) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(AppIdHeader, id.AppId)
+	req.Header.Set(PlanHeader, id.Plan)
+	req.Header.Set(ProviderHeader, id.Provider)
+	req.Header.Set(ScopesHeader, strings.Join(id.Scopes, ","))
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, signature(s.Key, id, timestamp, req.Method, req.URL.Path))
+}
+
+// Verify checks the identity signed by an HMACSigner with key,
+// refusing signatures older than maxAge.
+func Verify(req *http.Request, key []byte, maxAge time.Duration) (*Identity, error) {
+	sig := req.Header.Get(SignatureHeader)
+	timestamp := req.Header.Get(TimestampHeader)
+	if sig == "" || timestamp == "" {
+		return nil, ErrMissing
+	}
+
+	id := &Identity{
+		AppId:    req.Header.Get(AppIdHeader),
+		Plan:     req.Header.Get(PlanHeader),
+		Provider: req.Header.Get(ProviderHeader),
+	}
+	if scopes := req.Header.Get(ScopesHeader); scopes != "" {
+		id.Scopes = strings.Split(scopes, ",")
+	}
+
+	expected := signature(key, id, timestamp, req.Method, req.URL.Path)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return nil, ErrSignature
+	}
+	signed, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, ErrSignature
+	}
+	if time.Since(time.Unix(signed, 0)) > maxAge {
+		return nil, ErrExpired
+	}
+	return id, nil
+}
+
+// JWTSigner sends the identity as an HS256 JSON Web Token valid for TTL.
+type JWTSigner struct {
+	Key    []byte
+	TTL    time.Duration
+	Issuer string
+}
+
+type claims struct {
+	*Identity
+	Issuer    string `json:"iss,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func sign(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *JWTSigner) Sign(id *Identity, req *http.Request) {
+	now := time.Now()
+	body, _ := json.Marshal(&claims{
+		Identity:  id,
+		Issuer:    s.Issuer,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(s.TTL).Unix(),
+	})
+	payload := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(body)
+	req.Header.Set(TokenHeader, payload+"."+sign(s.Key, payload))
+}
+
+// VerifyJWT checks the identity signed by a JWTSigner with key.
+func VerifyJWT(req *http.Request, key []byte) (*Identity, error) {
+	token := req.Header.Get(TokenHeader)
+	if token == "" {
+		return nil, ErrMissing
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return nil, ErrSignature
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(sign(key, parts[0]+"."+parts[1]))) {
+		return nil, ErrSignature
+	}
+
+	body, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrSignature
+	}
+	c := &claims{Identity: &Identity{}}
+	if err := json.Unmarshal(body, c); err != nil {
+		return nil, ErrSignature
+	}
+	if time.Now().Unix() >= c.ExpiresAt {
+		return nil, ErrExpired
+	}
+	return c.Identity, nil
+}
@@ -0,0 +1,58 @@
+package identity
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHMACSigner(t *testing.T) {
+	key := []byte("secret")
+	id := &Identity{AppId: "MyApp", Plan: "Gold", Provider: "MyProvider", Scopes: []string{"read", "write"}}
+
+	req, _ := http.NewRequest("GET", "http://backend/service1/foo", nil)
+	(&HMACSigner{Key: key}).Sign(id, req)
+
+	verified, err := Verify(req, key, time.Minute)
+	if err != nil {
+		t.Fatal("A signed identity should be valid: ", err)
+	}
+	if verified.AppId != "MyApp" || verified.Plan != "Gold" || len(verified.Scopes) != 2 {
+		t.Error("Wrong identity: ", verified)
+	}
+
+	if _, err := Verify(req, []byte("other"), time.Minute); err != ErrSignature {
+		t.Error("A different key should not verify the identity, got ", err)
+	}
+
+	req.Header.Set(PlanHeader, "Platinum")
+	if _, err := Verify(req, key, time.Minute); err != ErrSignature {
+		t.Error("A changed identity should not be valid, got ", err)
+	}
+}
+
+func TestJWTSigner(t *testing.T) {
+	key := []byte("secret")
+	id := &Identity{AppId: "MyApp", Plan: "Gold"}
+
+	req, _ := http.NewRequest("GET", "http://backend/service1/foo", nil)
+	(&JWTSigner{Key: key, TTL: time.Minute}).Sign(id, req)
+
+	verified, err := VerifyJWT(req, key)
+	if err != nil || verified.AppId != "MyApp" || verified.Plan != "Gold" {
+		t.Error("A signed identity should be valid: ", verified, err)
+	}
+
+	(&JWTSigner{Key: key, TTL: -time.Minute}).Sign(id, req)
+	if _, err := VerifyJWT(req, key); err != ErrExpired {
+		t.Error("An old token should be expired, got ", err)
+	}
+}
+
+func TestStrip(t *testing.T) {
+	header := http.Header{"X-Authproxy-App-Id": {"Spoofed"}, "x-authproxy-plan": {"Spoofed"}, "Accept": {"*/*"}}
+	Strip(header)
+	if len(header) != 1 {
+		t.Error("Only the identity headers should be removed: ", header)
+	}
+}
@@ -2,6 +2,8 @@ package ioextra
 
 import (
 	"bytes"
+	"io"
+	"net/http"
 )
 
 type ClosingReader struct {
@@ -15,3 +17,20 @@ func (rnc ClosingReader) Close() error {
 func NewBufferizedClosingReader(b []byte) *ClosingReader {
 	return &ClosingReader{*bytes.NewReader(b)}
 }
+
+// LimitAndBufferBody reads body in memory, failing if it is bigger than maxSize.
+func LimitAndBufferBody(rw http.ResponseWriter, body io.ReadCloser, maxSize int64) (rc io.ReadCloser, err error) {
+	var buffer bytes.Buffer
+
+	// limit the request Body and buffer it
+	_, err = buffer.ReadFrom(http.MaxBytesReader(rw, body, maxSize))
+
+	if err != nil {
+		return
+	}
+
+	// we can't use NopCloser here, because we need to Seek after.
+	// ClosingReader (with its anonymous field) allows to do it
+	rc = NewBufferizedClosingReader(buffer.Bytes())
+	return
+}
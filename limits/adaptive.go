@@ -0,0 +1,87 @@
+package limits
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBackoffRatio     = 0.9
+	defaultLatencyThreshold = time.Second
+)
+
+// ConcurrencyStats describes the state of a ConcurrencyLimiter.
+type ConcurrencyStats struct {
+	Limit    int  `json:"limit"`
+	InFlight int  `json:"inFlight"`
+	Queued   int  `json:"queued"`
+	Adaptive bool `json:"adaptive"`
+}
+
+// AIMDLimit adapts the limit of a ConcurrencyLimiter to the health of the
+// backends: the limit grows by one every time a full limit of requests
+// completed quickly, and it's multiplied by BackoffRatio every time a
+// request fails or takes more than LatencyThreshold.
+// This sheds load before slow backends collapse under the queued requests.
+type AIMDLimit struct {
+	Limiter          *ConcurrencyLimiter
+	MinLimit         int
+	MaxLimit         int
+	LatencyThreshold time.Duration
+	BackoffRatio     float64
+
+	mu    sync.Mutex
+	limit float64
+}
+
+func NewAIMDLimit(limiter *ConcurrencyLimiter, minLimit, maxLimit int, threshold time.Duration, backoffRatio float64) *AIMDLimit {
+	if minLimit < 1 {
+		minLimit = 1
+	}
+	if maxLimit < minLimit {
+		maxLimit = minLimit
+	}
+	if threshold <= 0 {
+		threshold = defaultLatencyThreshold
+	}
+	if backoffRatio <= 0 || backoffRatio >= 1 {
+		backoffRatio = defaultBackoffRatio
+	}
+
+	initial := limiter.Limit()
+	if initial < minLimit {
+		initial = minLimit
+	} else if initial > maxLimit {
+		initial = maxLimit
+	}
+	limiter.SetLimit(initial)
+
+	return &AIMDLimit{
+		Limiter:          limiter,
+		MinLimit:         minLimit,
+		MaxLimit:         maxLimit,
+		LatencyThreshold: threshold,
+		BackoffRatio:     backoffRatio,
+		limit:            float64(initial),
+	}
+}
+
+// Observe adjusts the limit after a request that took d and maybe failed.
+func (a *AIMDLimit) Observe(d time.Duration, failed bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if failed || d > a.LatencyThreshold {
+		a.limit = math.Max(float64(a.MinLimit), a.limit*a.BackoffRatio)
+	} else {
+		inFlight, _ := a.Limiter.Stats()
+		// don't grow the limit if we are not using it
+		if 2*inFlight < int(a.limit) {
+			return
+		}
+		a.limit = math.Min(float64(a.MaxLimit), a.limit+1/a.limit)
+	}
+
+	a.Limiter.SetLimit(int(a.limit))
+}
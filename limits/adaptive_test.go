@@ -0,0 +1,37 @@
+package limits
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAIMDLimit(t *testing.T) {
+	limiter := NewConcurrencyLimiter(10, 0)
+	aimd := NewAIMDLimit(limiter, 2, 20, 100*time.Millisecond, 0.5)
+
+	aimd.Observe(time.Second, false)
+	if limiter.Limit() != 5 {
+		t.Error("A slow request should halve the limit, got", limiter.Limit())
+	}
+	aimd.Observe(time.Millisecond, true)
+	aimd.Observe(time.Millisecond, true)
+	if limiter.Limit() != 2 {
+		t.Error("The limit should not go below the minimum, got", limiter.Limit())
+	}
+
+	aimd.Observe(time.Millisecond, false)
+	if limiter.Limit() != 2 {
+		t.Error("The limit should not grow while it's not used, got", limiter.Limit())
+	}
+
+	for i := 0; i < 2; i++ {
+		limiter.Acquire(context.Background(), "app", 1, time.Second)
+	}
+	for i := 0; i < 6; i++ {
+		aimd.Observe(time.Millisecond, false)
+	}
+	if limiter.Limit() != 4 {
+		t.Error("Fast requests should grow the limit, got", limiter.Limit())
+	}
+}
@@ -0,0 +1,183 @@
+package limits
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQueueFull    = errors.New("the wait queue is full")
+	ErrQueueTimeout = errors.New("timed out waiting in queue")
+)
+
+type waiter struct {
+	app   string
+	tag   float64
+	seq   uint64
+	index int
+	ready chan bool
+}
+
+// waitQueue is a heap of waiters, sorted by virtual finish tag.
+type waitQueue []*waiter
+
+func (q waitQueue) Len() int { return len(q) }
+
+func (q waitQueue) Less(i, j int) bool {
+	if q[i].tag == q[j].tag {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].tag < q[j].tag
+}
+
+func (q waitQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *waitQueue) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *waitQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	*q = old[:len(old)-1]
+	w.index = -1
+	return w
+}
+
+// ConcurrencyLimiter bounds the number of requests in flight.
+// Requests over the limit wait in a bounded queue, which is served with
+// weighted fair queueing: every app gets a share of the slots proportional
+// to its weight, no matter how many requests it sends.
+type ConcurrencyLimiter struct {
+	MaxQueue int
+
+	mu       sync.Mutex
+	limit    int
+	inFlight int
+	queue    waitQueue
+	seq      uint64
+	// virtual time: the tag of the last dispatched waiter
+	now float64
+	// the last tag assigned to every app with waiting requests
+	lastTags map[string]float64
+}
+
+func NewConcurrencyLimiter(limit, maxQueue int) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		MaxQueue: maxQueue,
+		limit:    limit,
+		lastTags: make(map[string]float64),
+	}
+}
+
+func (l *ConcurrencyLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// SetLimit changes the maximum number of requests in flight,
+// letting waiting requests in if it grows.
+func (l *ConcurrencyLimiter) SetLimit(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	l.dispatchUnsafe()
+}
+
+// Stats returns the number of requests in flight and waiting in queue.
+func (l *ConcurrencyLimiter) Stats() (inFlight, queued int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inFlight, len(l.queue)
+}
+
+// Acquire waits for a slot for a request of app, for at most timeout or until ctx is done.
+// The returned release function must be called when the request is completed.
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context, app string, weight float64, timeout time.Duration) (release func(), err error) {
+	if weight <= 0 {
+		weight = 1
+	}
+
+	l.mu.Lock()
+	if l.inFlight < l.limit && len(l.queue) == 0 {
+		l.inFlight++
+		l.mu.Unlock()
+		return l.release, nil
+	}
+	if len(l.queue) >= l.MaxQueue {
+		l.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+
+	start, ok := l.lastTags[app]
+	if !ok || start < l.now {
+		start = l.now
+	}
+	l.seq++
+	w := &waiter{app: app, tag: start + 1/weight, seq: l.seq, ready: make(chan bool, 1)}
+	l.lastTags[app] = w.tag
+	heap.Push(&l.queue, w)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	err = ErrQueueTimeout
+	select {
+	case <-w.ready:
+		return l.release, nil
+	case <-timer.C:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w.index < 0 {
+		if err != ErrQueueTimeout {
+			// dispatched while the request went away: give the slot to the next one
+			l.inFlight--
+			l.dispatchUnsafe()
+			return nil, err
+		}
+		// dispatched while timing out: the slot is ours anyway
+		return l.release, nil
+	}
+	heap.Remove(&l.queue, w.index)
+	l.forgetUnsafe(w)
+	return nil, err
+}
+
+func (l *ConcurrencyLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	l.dispatchUnsafe()
+}
+
+// forgetUnsafe drops the tag of an app that has no more waiting requests.
+func (l *ConcurrencyLimiter) forgetUnsafe(w *waiter) {
+	if l.lastTags[w.app] == w.tag {
+		delete(l.lastTags, w.app)
+	}
+}
+
+func (l *ConcurrencyLimiter) dispatchUnsafe() {
+	for l.inFlight < l.limit && len(l.queue) > 0 {
+		w := heap.Pop(&l.queue).(*waiter)
+		l.now = w.tag
+		l.forgetUnsafe(w)
+		l.inFlight++
+		w.ready <- true
+	}
+}
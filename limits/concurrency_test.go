@@ -0,0 +1,125 @@
+package limits
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitQueued waits until n requests are waiting in the limiter queue.
+func waitQueued(l *ConcurrencyLimiter, n int) {
+	for {
+		if _, queued := l.Stats(); queued == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConcurrencyLimiterIsFair(t *testing.T) {
+	limiter := NewConcurrencyLimiter(1, 10)
+	release, err := limiter.Acquire(context.Background(), "greedy", 1, time.Second)
+	if err != nil {
+		t.Fatal("The first request should get a slot, got", err)
+	}
+
+	var (
+		mu    sync.Mutex
+		order []string
+		wg    sync.WaitGroup
+	)
+	enqueue := func(app string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := limiter.Acquire(context.Background(), app, 1, time.Second)
+			if err != nil {
+				t.Error("Request of", app, "failed:", err)
+				return
+			}
+			mu.Lock()
+			order = append(order, app)
+			mu.Unlock()
+			release()
+		}()
+	}
+
+	for i := 0; i < 3; i++ {
+		enqueue("greedy")
+		waitQueued(limiter, i+1)
+	}
+	enqueue("polite")
+	waitQueued(limiter, 4)
+
+	release()
+	wg.Wait()
+
+	if len(order) != 4 || order[1] != "polite" {
+		t.Error("The polite app should be served right after the first greedy request, got", order)
+	}
+}
+
+func TestConcurrencyLimiterRefusesRequests(t *testing.T) {
+	limiter := NewConcurrencyLimiter(1, 1)
+	release, _ := limiter.Acquire(context.Background(), "app", 1, time.Second)
+	defer release()
+
+	errs := make(chan error)
+	go func() {
+		_, err := limiter.Acquire(context.Background(), "app", 1, 20*time.Millisecond)
+		errs <- err
+	}()
+	waitQueued(limiter, 1)
+
+	if _, err := limiter.Acquire(context.Background(), "app", 1, time.Second); err != ErrQueueFull {
+		t.Error("Expected", ErrQueueFull, "got", err)
+	}
+	if err := <-errs; err != ErrQueueTimeout {
+		t.Error("Expected", ErrQueueTimeout, "got", err)
+	}
+	if inFlight, queued := limiter.Stats(); inFlight != 1 || queued != 0 {
+		t.Error("Expected 1 request in flight and none queued, got", inFlight, queued)
+	}
+}
+
+func TestConcurrencyLimiterCancel(t *testing.T) {
+	limiter := NewConcurrencyLimiter(1, 1)
+	release, _ := limiter.Acquire(context.Background(), "app", 1, time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		_, err := limiter.Acquire(ctx, "gone", 1, time.Minute)
+		errs <- err
+	}()
+	waitQueued(limiter, 1)
+
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Error("Expected", context.Canceled, "got", err)
+	}
+	if inFlight, queued := limiter.Stats(); inFlight != 1 || queued != 0 {
+		t.Error("The request gone away should leave the queue, got", inFlight, queued)
+	}
+
+	release()
+	if inFlight, _ := limiter.Stats(); inFlight != 0 {
+		t.Error("The request gone away should not take the slot, got", inFlight)
+	}
+}
+
+func TestConcurrencyLimiterSetLimit(t *testing.T) {
+	limiter := NewConcurrencyLimiter(0, 1)
+	acquired := make(chan bool)
+	go func() {
+		_, err := limiter.Acquire(context.Background(), "app", 1, time.Second)
+		acquired <- err == nil
+	}()
+	waitQueued(limiter, 1)
+
+	limiter.SetLimit(1)
+	if !<-acquired {
+		t.Error("Raising the limit should let waiting requests in")
+	}
+}
@@ -0,0 +1,118 @@
+// Limits protects the backends from applications that send too many requests.
+package limits
+
+import (
+	log "github.com/gigaroby/gopherlog"
+	"math"
+	"sync"
+	"time"
+)
+
+// how many calls to Allow between two sweeps of the idle buckets
+const sweepEvery = 1024
+
+var (
+	logger = log.GetLogger("authproxy.limits")
+)
+
+// Rate allows PerSecond requests every second, with bursts of up to Burst requests.
+type Rate struct {
+	PerSecond float64 `json:"perSecond"`
+	Burst     int     `json:"burst"`
+}
+
+func (r Rate) IsZero() bool {
+	return r.PerSecond <= 0
+}
+
+func (r Rate) burst() float64 {
+	if r.Burst < 1 {
+		return 1
+	}
+	return float64(r.Burst)
+}
+
+// Result is the outcome of a rate limit check.
+type Result struct {
+	Allowed bool
+	// Limit is the maximum number of requests allowed in a burst.
+	Limit int
+	// Remaining is the number of requests that would be allowed right now.
+	Remaining int
+	// Reset is the time after which the quota is fully restored.
+	Reset time.Duration
+	// RetryAfter is the time after which the next request would be allowed.
+	RetryAfter time.Duration
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// when the bucket will be full again if left alone
+	fullAt time.Time
+}
+
+// RateLimiter is a set of token buckets, one for every key.
+type RateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	calls   int
+	now     func() time.Time
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket of key, which is refilled at the given rate.
+func (l *RateLimiter) Allow(key string, rate Rate) Result {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	burst := rate.burst()
+
+	l.calls++
+	if l.calls%sweepEvery == 0 {
+		l.sweepUnsafe(now)
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = bucket
+	}
+
+	elapsed := now.Sub(bucket.last).Seconds()
+	bucket.tokens = math.Min(burst, bucket.tokens+elapsed*rate.PerSecond)
+	bucket.last = now
+
+	res := Result{Limit: int(burst)}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = secondsToDuration((1 - bucket.tokens) / rate.PerSecond)
+	}
+	res.Remaining = int(bucket.tokens)
+	res.Reset = secondsToDuration((burst - bucket.tokens) / rate.PerSecond)
+	bucket.fullAt = now.Add(res.Reset)
+
+	return res
+}
+
+// sweepUnsafe drops the buckets that have been idle long enough to be full again.
+func (l *RateLimiter) sweepUnsafe(now time.Time) {
+	for key, bucket := range l.buckets {
+		if now.After(bucket.fullAt) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(math.Ceil(s * float64(time.Second)))
+}
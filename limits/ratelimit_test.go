@@ -0,0 +1,71 @@
+package limits
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func TestRateLimiterAllowsBursts(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	limiter := NewRateLimiter()
+	limiter.now = clock.Now
+	rate := Rate{PerSecond: 1, Burst: 3}
+
+	for i := 0; i < 3; i++ {
+		if res := limiter.Allow("app", rate); !res.Allowed {
+			t.Fatal("Request", i, "of the burst should be allowed")
+		}
+	}
+
+	res := limiter.Allow("app", rate)
+	if res.Allowed {
+		t.Fatal("The request after the burst should be refused")
+	}
+	if res.Remaining != 0 || res.Limit != 3 {
+		t.Error("Expected limit 3 and 0 remaining, got", res.Limit, res.Remaining)
+	}
+	if res.RetryAfter != time.Second {
+		t.Error("Expected to retry after 1s, got", res.RetryAfter)
+	}
+
+	if res := limiter.Allow("other-app", rate); !res.Allowed {
+		t.Error("Apps should not share the same bucket")
+	}
+
+	clock.Advance(time.Second)
+	if res := limiter.Allow("app", rate); !res.Allowed {
+		t.Error("The bucket should be refilled after a second")
+	}
+}
+
+func TestRateLimiterSweepsFullBuckets(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	limiter := NewRateLimiter()
+	limiter.now = clock.Now
+	rate := Rate{PerSecond: 10, Burst: 1}
+
+	limiter.Allow("app", rate)
+	clock.Advance(time.Minute)
+	for i := 1; i < sweepEvery; i++ {
+		limiter.Allow("busy-app", rate)
+	}
+
+	if _, ok := limiter.buckets["app"]; ok {
+		t.Error("Idle buckets should be dropped")
+	}
+	if _, ok := limiter.buckets["busy-app"]; !ok {
+		t.Error("Buckets in use should be kept")
+	}
+}
@@ -0,0 +1,190 @@
+package limits
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	redisKeyPrefix   = "authproxy:ratelimit:"
+	redisMaxIdle     = 16
+	redisDefaultWait = 100 * time.Millisecond
+)
+
+// RedisStore keeps the counters on a server speaking the Redis protocol.
+type RedisStore struct {
+	Addr string
+	// Timeout bounds connecting and every round trip to the server.
+	Timeout time.Duration
+
+	idle chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func NewRedisStore(addr string, timeout time.Duration) *RedisStore {
+	if timeout <= 0 {
+		timeout = redisDefaultWait
+	}
+	return &RedisStore{
+		Addr:    addr,
+		Timeout: timeout,
+		idle:    make(chan *redisConn, redisMaxIdle),
+	}
+}
+
+func (s *RedisStore) get() (*redisConn, error) {
+	select {
+	case conn := <-s.idle:
+		return conn, nil
+	default:
+	}
+
+	conn, err := net.DialTimeout("tcp", s.Addr, s.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &redisConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (s *RedisStore) put(conn *redisConn) {
+	select {
+	case s.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// do sends all the commands in a single write and reads their replies.
+func (s *RedisStore) do(commands ...[]string) (replies []interface{}, err error) {
+	conn, err := s.get()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+		} else {
+			s.put(conn)
+		}
+	}()
+
+	conn.SetDeadline(time.Now().Add(s.Timeout))
+
+	var buf bytes.Buffer
+	for _, args := range commands {
+		fmt.Fprintf(&buf, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if _, err = conn.Write(buf.Bytes()); err != nil {
+		return
+	}
+
+	for _ = range commands {
+		var reply interface{}
+		reply, err = readReply(conn.r)
+		if err != nil {
+			return
+		}
+		replies = append(replies, reply)
+	}
+	return
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", redisError("malformed reply")
+	}
+	return line[:len(line)-2], nil
+}
+
+// readReply reads a reply, returning it as int64, string, nil or []interface{}.
+// Error replies are returned as a redisError.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		elements := make([]interface{}, size)
+		for i := range elements {
+			if elements[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return elements, nil
+	}
+	return nil, redisError("unknown reply type " + line[:1])
+}
+
+func windowKey(key string, start time.Time) string {
+	return redisKeyPrefix + key + ":" + strconv.FormatInt(start.UnixNano()/int64(time.Millisecond), 10)
+}
+
+func (s *RedisStore) IncrWindow(key string, start time.Time, window time.Duration) (current, previous int64, err error) {
+	currentKey := windowKey(key, start)
+	previousKey := windowKey(key, start.Add(-window))
+	// the counter is needed until the end of the next window
+	ttl := strconv.FormatInt(int64(2*window/time.Millisecond), 10)
+
+	replies, err := s.do(
+		[]string{"INCR", currentKey},
+		[]string{"PEXPIRE", currentKey, ttl},
+		[]string{"GET", previousKey},
+	)
+	if err != nil {
+		return
+	}
+
+	current, ok := replies[0].(int64)
+	if !ok {
+		err = redisError("unexpected reply to INCR")
+		return
+	}
+	if count, ok := replies[2].(string); ok {
+		previous, err = strconv.ParseInt(count, 10, 64)
+	}
+	return
+}
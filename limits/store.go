@@ -0,0 +1,100 @@
+package limits
+
+import (
+	"sync"
+	"time"
+)
+
+// how long to use only the local limits after the store failed
+const storeRetryInterval = 5 * time.Second
+
+// Limiter decides if a request identified by key is within rate.
+type Limiter interface {
+	Allow(key string, rate Rate) Result
+}
+
+// A Store keeps request counters that are shared by all the proxy instances.
+type Store interface {
+	// IncrWindow increments the counter of key for the window starting at
+	// start and returns it along with the counter of the previous window.
+	IncrWindow(key string, start time.Time, window time.Duration) (current, previous int64, err error)
+}
+
+// SlidingWindowLimiter allows Burst requests in a window of Burst/PerSecond
+// seconds, using counters kept in a Store. The count of the previous window
+// is weighted by how much it overlaps the sliding window ending now.
+// Requests over the limit are counted too, so apps that keep hammering stay blocked.
+// When the store can't be reached it falls back to Local for a while.
+type SlidingWindowLimiter struct {
+	Store Store
+	Local Limiter
+
+	mu        sync.Mutex
+	downUntil time.Time
+	now       func() time.Time
+}
+
+func NewSlidingWindowLimiter(store Store) *SlidingWindowLimiter {
+	return &SlidingWindowLimiter{
+		Store: store,
+		Local: NewRateLimiter(),
+		now:   time.Now,
+	}
+}
+
+func (r Rate) window() time.Duration {
+	return secondsToDuration(r.burst() / r.PerSecond)
+}
+
+func (l *SlidingWindowLimiter) storeAvailable(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return now.After(l.downUntil)
+}
+
+func (l *SlidingWindowLimiter) storeFailed(now time.Time, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	logger.Warning("Rate limit store unreachable, using local limits: ", err.Error())
+	l.downUntil = now.Add(storeRetryInterval)
+}
+
+func (l *SlidingWindowLimiter) Allow(key string, rate Rate) Result {
+	now := l.now()
+	if !l.storeAvailable(now) {
+		return l.Local.Allow(key, rate)
+	}
+
+	window := rate.window()
+	start := now.Truncate(window)
+	current, previous, err := l.Store.IncrWindow(key, start, window)
+	if err != nil {
+		l.storeFailed(now, err)
+		return l.Local.Allow(key, rate)
+	}
+
+	limit := rate.burst()
+	elapsed := now.Sub(start)
+	overlap := 1 - float64(elapsed)/float64(window)
+	count := float64(previous)*overlap + float64(current)
+
+	res := Result{
+		Allowed: count <= limit,
+		Limit:   int(limit),
+		Reset:   window - elapsed,
+	}
+	if res.Allowed {
+		res.Remaining = int(limit - count)
+		return res
+	}
+
+	if float64(current) < limit && previous > 0 {
+		// wait until enough of the previous window slides away
+		needed := 1 - (limit-float64(current))/float64(previous)
+		res.RetryAfter = time.Duration(needed*float64(window)) - elapsed
+	}
+	if res.RetryAfter <= 0 || res.RetryAfter > res.Reset {
+		res.RetryAfter = res.Reset
+	}
+	return res
+}
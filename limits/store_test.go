@@ -0,0 +1,67 @@
+package limits
+
+import (
+	. "github.com/gigaroby/authproxy/testutils"
+	"testing"
+	"time"
+)
+
+func TestSlidingWindowLimiterIsShared(t *testing.T) {
+	redis, err := NewFakeRedis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer redis.Close()
+
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	rate := Rate{PerSecond: 1, Burst: 4}
+	instances := []*SlidingWindowLimiter{
+		NewSlidingWindowLimiter(NewRedisStore(redis.Addr, time.Second)),
+		NewSlidingWindowLimiter(NewRedisStore(redis.Addr, time.Second)),
+	}
+	for _, instance := range instances {
+		instance.now = clock.Now
+	}
+
+	for i := 0; i < 4; i++ {
+		if res := instances[i%2].Allow("app", rate); !res.Allowed {
+			t.Fatal("Request", i, "should be allowed")
+		}
+	}
+	for _, instance := range instances {
+		if res := instance.Allow("app", rate); res.Allowed {
+			t.Error("The limit should be shared by all the instances")
+		} else if res.RetryAfter <= 0 {
+			t.Error("RetryAfter should be set, got", res.RetryAfter)
+		}
+	}
+
+	// half of the previous window (6 requests) still counts
+	clock.Advance(6 * time.Second)
+	if res := instances[0].Allow("app", rate); !res.Allowed || res.Remaining != 0 {
+		t.Error("Expected the request to be the last allowed one, got", res)
+	}
+	if res := instances[1].Allow("app", rate); res.Allowed {
+		t.Error("The previous window should be taken into account")
+	}
+}
+
+func TestSlidingWindowLimiterFallsBackToLocal(t *testing.T) {
+	redis, err := NewFakeRedis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	redis.Close()
+
+	limiter := NewSlidingWindowLimiter(NewRedisStore(redis.Addr, 100*time.Millisecond))
+	rate := Rate{PerSecond: 1, Burst: 2}
+
+	for i := 0; i < 2; i++ {
+		if res := limiter.Allow("app", rate); !res.Allowed {
+			t.Fatal("Request", i, "should be allowed by the local limits")
+		}
+	}
+	if res := limiter.Allow("app", rate); res.Allowed {
+		t.Error("The local limits should be enforced")
+	}
+}
@@ -2,11 +2,18 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"flag"
+	"github.com/gigaroby/authproxy/accesslog"
+	"github.com/gigaroby/authproxy/admin"
 	"github.com/gigaroby/authproxy/authbroker"
 	"github.com/gigaroby/authproxy/authserver"
+	"github.com/gigaroby/authproxy/identity"
+	"github.com/gigaroby/authproxy/limits"
 	"github.com/gigaroby/authproxy/proxy"
+	"github.com/gigaroby/authproxy/tracing"
 	log "github.com/gigaroby/gopherlog"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
@@ -24,8 +31,32 @@ var (
 	serviceFile             = flag.String("services-file", "/etc/authproxy/services.json", "file to load services from")
 	backendsFile            = flag.String("backends-file", "/etc/authproxy/backends.json", "file to load backends from")
 	adminPath               = flag.String("admin", "admin", "change the admin path (it will be on '/THIS_VALUE/'")
+	adminAddr               = flag.String("admin-addr", "", "address (e.g. 127.0.0.1:8081) to serve the admin and profiler on, instead of the proxy port")
+	adminToken              = flag.String("admin-token", "", "token required in 'Authorization: Bearer' by the admin endpoints")
+	adminUsers              = flag.String("admin-users", "", "comma separated user:password pairs allowed to use the admin endpoints with basic auth")
+	adminTLSCert            = flag.String("admin-tls-cert", "", "certificate file to serve the admin listener with TLS")
+	adminTLSKey             = flag.String("admin-tls-key", "", "key file to serve the admin listener with TLS")
+	adminClientCA           = flag.String("admin-client-ca", "", "CA file to verify client certificates on the admin listener with (enables mTLS)")
+	adminAuditLog           = flag.String("admin-audit-log", "", "file to write the audit log of the admin requests to ('-' for stdout)")
 	sentryDSN               = flag.String("sentry-dsn", "", "set the sentry dsn to be used for logging purposes")
 	skipTLSVerify           = flag.Bool("skip-tls-verify", false, "skip the TLS check while connecting to backends")
+	appIdHeader             = flag.String("app-id-header", "", "header to read the app id from (e.g. X-App-Id)")
+	appKeyHeader            = flag.String("app-key-header", "", "header to read the app key from (e.g. X-App-Key)")
+	providerHeader          = flag.String("provider-header", "", "header to read the provider label from")
+	authSchemes             = flag.String("auth-schemes", "", "comma separated Authorization schemes carrying app_id:app_key (e.g. Basic)")
+	rateLimitRedis          = flag.String("ratelimit-redis", "", "address (host:port) of the Redis server to share rate limits between instances")
+	rateLimitRedisTimeout   = flag.Duration("ratelimit-redis-timeout", 100*time.Millisecond, "timeout of the calls to the rate limit Redis server")
+	traceEndpoint           = flag.String("trace-otlp-endpoint", "", "base URL of the OTLP/HTTP collector to send traces to (e.g. http://localhost:4318)")
+	traceStdout             = flag.Bool("trace-stdout", false, "write traces to stdout (for debugging)")
+	traceServiceName        = flag.String("trace-service-name", "authproxy", "service name used in traces")
+	accessLog               = flag.String("access-log", "", "file to write the access log of the service requests to ('-' for stdout, disabled if empty)")
+	accessLogFormat         = flag.String("access-log-format", "combined", "access log format: combined, json or template: followed by a text/template")
+	accessLogMaxSize        = flag.Int64("access-log-max-size", 100, "size (in MB) after which the access log is rotated (0 to disable rotation)")
+	accessLogMaxBackups     = flag.Int("access-log-max-backups", 5, "number of rotated access logs to keep")
+	accessLogRedact         = flag.String("access-log-redact", "", "comma separated query parameters not to log ($app_key is never logged)")
+	identityHMACKey         = flag.String("identity-hmac-key", "", "key to sign the identity of the apps sent to the backends with HMAC-SHA256")
+	identityJWTKey          = flag.String("identity-jwt-key", "", "key to sign the identity of the apps sent to the backends as an HS256 JWT")
+	identityJWTTTL          = flag.Duration("identity-jwt-ttl", time.Minute, "validity of the identity JWTs")
 	timeout                 = time.Duration(2) * time.Second // this should be configurable for every service
 )
 
@@ -42,6 +73,79 @@ func setupLogging() *log.Logger {
 	return logger
 }
 
+func setupAccessLog(logger *log.Logger) *accesslog.Logger {
+	formatter, err := accesslog.NewFormatter(*accessLogFormat)
+	if err != nil {
+		logger.Fatal("Invalid access log format: ", err.Error())
+	}
+
+	accessLogger := &accesslog.Logger{Formatter: formatter, Out: os.Stdout}
+	if *accessLog != "-" {
+		file, err := accesslog.OpenRotatingFile(*accessLog, *accessLogMaxSize<<20, *accessLogMaxBackups)
+		if err != nil {
+			logger.Fatal("Can't open the access log: ", err.Error())
+		}
+		accessLogger.Out = file
+	}
+	if *accessLogRedact != "" {
+		accessLogger.Redact = strings.Split(*accessLogRedact, ",")
+	}
+	return accessLogger
+}
+
+func setupAdmin(logger *log.Logger, adminHandler http.Handler) (*admin.AuthHandle, *tls.Config) {
+	auth := &admin.AuthHandle{Handler: adminHandler, Token: *adminToken}
+
+	if *adminUsers != "" {
+		auth.Users = make(map[string]string)
+		for _, pairString := range strings.Split(*adminUsers, ",") {
+			pair := strings.SplitN(pairString, ":", 2)
+			if len(pair) != 2 {
+				logger.Fatal("Invalid user:password pair: ", pairString)
+			}
+			auth.Users[pair[0]] = pair[1]
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if *adminClientCA != "" {
+		if *adminAddr == "" || *adminTLSCert == "" {
+			logger.Fatal("--admin-client-ca requires --admin-addr and --admin-tls-cert")
+		}
+		content, err := ioutil.ReadFile(*adminClientCA)
+		if err != nil {
+			logger.Fatal("Can't read the admin client CA: ", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			logger.Fatal("No certificates found in ", *adminClientCA)
+		}
+		// clients without a certificate can still use the token or basic auth
+		tlsConfig = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+		auth.ClientCert = true
+	}
+
+	if auth.Token == "" && len(auth.Users) == 0 && !auth.ClientCert {
+		// anyone reaching the proxy could change the backends
+		if *adminAddr == "" {
+			logger.Fatal("admin endpoints on the proxy port must be protected, use --admin-token, --admin-users or --admin-addr")
+		}
+		logger.Warning("admin endpoints are not protected, use --admin-token, --admin-users or --admin-client-ca")
+	}
+
+	if *adminAuditLog != "" {
+		auth.Audit = &admin.AuditLog{Out: os.Stdout}
+		if *adminAuditLog != "-" {
+			file, err := accesslog.OpenRotatingFile(*adminAuditLog, *accessLogMaxSize<<20, *accessLogMaxBackups)
+			if err != nil {
+				logger.Fatal("Can't open the audit log: ", err.Error())
+			}
+			auth.Audit.Out = file
+		}
+	}
+	return auth, tlsConfig
+}
+
 func dialTimeout(network, addr string) (net.Conn, error) {
 	return net.DialTimeout(network, addr, timeout)
 }
@@ -52,9 +156,18 @@ func main() {
 
 	logger := setupLogging()
 
+	credentials := &authbroker.CredentialsParser{
+		AppIdHeader:    *appIdHeader,
+		AppKeyHeader:   *appKeyHeader,
+		ProviderHeader: *providerHeader,
+	}
+	if *authSchemes != "" {
+		credentials.AuthSchemes = strings.Split(*authSchemes, ",")
+	}
+
 	var broker authbroker.AuthenticationBroker
 	if *yesBroker {
-		broker = &authbroker.YesBroker{}
+		broker = &authbroker.YesBroker{Credentials: credentials}
 	} else {
 		if providerKey == "" {
 			logger.Fatal("Missing parameter --3scale-provider-key")
@@ -71,7 +184,16 @@ func main() {
 				pkAltsMap[pair[0]] = pair[1]
 			}
 		}
-		broker = authbroker.NewThreeScaleBroker(providerKey, pkAltsMap, nil)
+		tBroker := authbroker.NewThreeScaleBroker(providerKey, pkAltsMap, nil)
+		tBroker.Credentials = credentials
+		broker = tBroker
+	}
+
+	tracing.DefaultTracer.ServiceName = *traceServiceName
+	if *traceEndpoint != "" {
+		tracing.DefaultTracer.Exporter = tracing.NewOTLPExporter(*traceEndpoint, *traceServiceName, nil)
+	} else if *traceStdout {
+		tracing.DefaultTracer.Exporter = &tracing.StdoutExporter{Out: os.Stdout, ServiceName: *traceServiceName}
 	}
 
 	// TODO[vad]: check if files exist
@@ -83,8 +205,42 @@ func main() {
 		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	}
 
-	proxyHandler := proxy.NewProxyHandler(broker, transport, *serviceFile, *backendsFile)
-	authServer := authserver.NewHandle(broker, proxyHandler, *adminPath, *enableProfiler)
+	proxyOpts := &proxy.Options{}
+	if *accessLog != "" {
+		proxyOpts.AccessLog = setupAccessLog(logger)
+	}
+	if *rateLimitRedis != "" {
+		proxyOpts.RateLimitStore = limits.NewRedisStore(*rateLimitRedis, *rateLimitRedisTimeout)
+	}
+
+	if *identityJWTKey != "" {
+		proxyOpts.Identity = &identity.JWTSigner{Key: []byte(*identityJWTKey), TTL: *identityJWTTTL, Issuer: "authproxy"}
+	} else if *identityHMACKey != "" {
+		proxyOpts.Identity = &identity.HMACSigner{Key: []byte(*identityHMACKey)}
+	}
+
+	proxyHandler := proxy.NewProxyHandler(broker, transport, *serviceFile, *backendsFile, proxyOpts)
+	adminHandler, adminTLS := setupAdmin(logger, authserver.NewAdminHandle(broker, proxyHandler, *adminPath, *enableProfiler))
+
+	var authServer *authserver.Handle
+	if *adminAddr != "" {
+		authServer = authserver.NewHandle(proxyHandler, nil, *adminPath)
+
+		adminServer := &http.Server{
+			Addr:      *adminAddr,
+			Handler:   adminHandler,
+			TLSConfig: adminTLS,
+		}
+		go func() {
+			if *adminTLSCert != "" {
+				logger.Fatal(adminServer.ListenAndServeTLS(*adminTLSCert, *adminTLSKey))
+			} else {
+				logger.Fatal(adminServer.ListenAndServe())
+			}
+		}()
+	} else {
+		authServer = authserver.NewHandle(proxyHandler, adminHandler, *adminPath)
+	}
 
 	server := &http.Server{
 		Addr:    PROXY_PORT,
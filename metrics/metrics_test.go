@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	counter := NewCounterVec("test_requests_total", "Requests.", "service", "code")
+	gauge := NewGaugeVec("test_queue_depth", "Queue depth.")
+	histogram := NewHistogramVec("test_duration_seconds", "Durations.", []float64{0.1, 1}, "service")
+
+	counter.Inc("service1", "2xx")
+	counter.Add(2, "service1", "2xx")
+	counter.Inc(`se"rvice`, "5xx")
+	gauge.Add(3)
+	gauge.Add(-1)
+	histogram.Observe(0.05, "service1")
+	histogram.Observe(0.5, "service1")
+	histogram.Observe(5, "service1")
+
+	var buf bytes.Buffer
+	DefaultRegistry.Expose(&buf)
+	out := buf.String()
+
+	for _, expected := range []string{
+		"# TYPE test_requests_total counter\n",
+		`test_requests_total{service="service1",code="2xx"} 3` + "\n",
+		`test_requests_total{service="se\"rvice",code="5xx"} 1` + "\n",
+		"# TYPE test_queue_depth gauge\ntest_queue_depth 2\n",
+		`test_duration_seconds_bucket{service="service1",le="0.1"} 1` + "\n",
+		`test_duration_seconds_bucket{service="service1",le="1"} 2` + "\n",
+		`test_duration_seconds_bucket{service="service1",le="+Inf"} 3` + "\n",
+		`test_duration_seconds_sum{service="service1"} 5.55` + "\n",
+		`test_duration_seconds_count{service="service1"} 3` + "\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q in the output:\n%s", expected, out)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost/admin/metrics", nil)
+	Handler().ServeHTTP(rw, req)
+
+	if rw.Code != 200 || !strings.HasPrefix(rw.Header().Get("Content-Type"), "text/plain") {
+		t.Error("Expected a 200 text/plain response, got", rw.Code, rw.Header().Get("Content-Type"))
+	}
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"github.com/gigaroby/authproxy/accesslog"
+	"github.com/gigaroby/authproxy/ioextra"
+	"net/http"
+	"time"
+)
+
+// logAccess writes the access log entry of req, using the data we log for every request.
+func (h *ServiceHandler) logAccess(req *http.Request, rw *ioextra.ResponseWriter, url string, start time.Time, reqData map[string]interface{}) {
+	if h.AccessLog == nil {
+		return
+	}
+
+	entry := &accesslog.Entry{
+		Time:       start,
+		RemoteAddr: req.RemoteAddr,
+		Method:     req.Method,
+		URL:        url,
+		Proto:      req.Proto,
+		Status:     rw.Status,
+		Bytes:      rw.Bytes,
+		Referer:    req.Referer(),
+		UserAgent:  req.UserAgent(),
+		Service:    h.Name,
+		Duration:   time.Now().Sub(start),
+	}
+	entry.RequestId, _ = reqData["request_id"].(string)
+	entry.AppId, _ = reqData["app_id"].(string)
+	entry.Backend, _ = reqData["backend"].(string)
+	entry.Attempts, _ = reqData["attempts"].(int)
+	entry.UpstreamLatency, _ = reqData["duration"].(time.Duration)
+	entry.AuthLatency, _ = reqData["auth_duration"].(time.Duration)
+
+	h.AccessLog.Log(entry)
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"bytes"
+	"github.com/gigaroby/authproxy/aerrors"
+	"github.com/gigaroby/authproxy/ioextra"
+	"io"
+	"net/http"
+)
+
+const defaultMaxBodySize = 1 << 20 // 1MB
+
+var errRequestTooLarge = aerrors.ResponseError{Message: "Request too large", Status: 400, Code: "error.requestTooLarge"}
+
+// BodyConf controls how the request bodies of a service reach the backends.
+// By default they are read in memory, up to 1MB, before being sent.
+type BodyConf struct {
+	// maximum size of a request body, in bytes
+	MaxSize int64 `json:"maxSize"`
+	// Stream sends the bodies to the backends while they are read from the clients.
+	// Form encoded bodies are still read in memory to look for the credentials.
+	Stream bool `json:"stream"`
+	// how much of a streamed body (in bytes) is kept in memory to retry the request,
+	// bigger bodies are sent only once
+	RetryBuffer int64 `json:"retryBuffer"`
+	// IdempotentRetriesOnly retries only GET, HEAD, OPTIONS, PUT and DELETE requests.
+	IdempotentRetriesOnly bool `json:"idempotentRetriesOnly"`
+}
+
+func (c *BodyConf) maxSize() int64 {
+	if c == nil || c.MaxSize <= 0 {
+		return defaultMaxBodySize
+	}
+	return c.MaxSize
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// limitedBody fails the reads past the maximum size and remembers it,
+// so that a streamed request failing because of that is not blamed on the backend.
+type limitedBody struct {
+	io.ReadCloser
+	left     int64
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (n int, err error) {
+	if b.exceeded {
+		return 0, errRequestTooLarge
+	}
+	if b.left <= 0 {
+		// a body as big as the limit is fine, as long as it ends there
+		var probe [1]byte
+		if n, _ := b.ReadCloser.Read(probe[:]); n > 0 {
+			b.exceeded = true
+			return 0, errRequestTooLarge
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	n, err = b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	return
+}
+
+// limitBody enforces the maximum body size of the service, reading the body
+// in memory unless it's streamed. It returns the streamed body, if any.
+func (h *ServiceHandler) limitBody(rw http.ResponseWriter, req *http.Request) (*limitedBody, *aerrors.ResponseError) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+
+	conf := h.Conf.Body
+	maxSize := conf.maxSize()
+	if req.ContentLength > maxSize {
+		return nil, &errRequestTooLarge
+	}
+
+	if conf == nil || !conf.Stream {
+		body, err := ioextra.LimitAndBufferBody(rw, req.Body, maxSize)
+		if err != nil {
+			return nil, &errRequestTooLarge
+		}
+		req.Body = body
+		// e.g. inflated bodies
+		if r, ok := body.(*ioextra.ClosingReader); ok && req.ContentLength < 0 {
+			req.ContentLength = r.Size()
+		}
+		return nil, nil
+	}
+
+	limited := &limitedBody{ReadCloser: req.Body, left: maxSize}
+	req.Body = limited
+	return limited, nil
+}
+
+// maxAttempts tells how many times req can be sent to the backends,
+// reading in memory the beginning of a streamed body if it's allowed to.
+func (h *ServiceHandler) maxAttempts(req *http.Request) int {
+	conf := h.Conf.Body
+	if conf != nil && conf.IdempotentRetriesOnly && !isIdempotent(req.Method) {
+		return 1
+	}
+
+	if req.Body == nil || req.Body == http.NoBody {
+		return 3
+	}
+	if _, ok := req.Body.(io.Seeker); ok {
+		return 3
+	}
+
+	if conf == nil || conf.RetryBuffer <= 0 {
+		return 1
+	}
+	var buffer bytes.Buffer
+	_, err := buffer.ReadFrom(io.LimitReader(req.Body, conf.RetryBuffer+1))
+	if err == nil && int64(buffer.Len()) <= conf.RetryBuffer {
+		req.Body.Close()
+		req.Body = ioextra.NewBufferizedClosingReader(buffer.Bytes())
+		return 3
+	}
+	// too big, or broken: send what was read and then the rest
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(&buffer, req.Body), req.Body}
+	return 1
+}
@@ -0,0 +1,365 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gigaroby/authproxy/authbroker"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCacheEntries   = 1000
+	defaultCacheSize      = 64 << 20
+	defaultCacheEntrySize = 1 << 20
+)
+
+// the statuses that can be cached without being told explicitly (RFC 7231)
+var cacheableStatus = map[int]bool{200: true, 203: true, 301: true, 404: true, 410: true}
+
+// CacheConf caches the responses to the GET requests, as the backends allow with
+// Cache-Control, Expires, ETag, Last-Modified and Vary.
+type CacheConf struct {
+	// "memory" (the default) or "disk"
+	Store string `json:"store"`
+	// where the disk store keeps the responses, in a subdirectory named after the service
+	Dir string `json:"dir"`
+	// how many responses the memory store keeps (1000 by default)
+	MaxEntries int `json:"maxEntries"`
+	// how many bytes the store keeps (64MB by default)
+	MaxSize int64 `json:"maxSize"`
+	// bigger responses are not cached (1MB by default)
+	MaxEntrySize int64 `json:"maxEntrySize"`
+	// how long (in seconds) the responses without an explicit expiration are fresh;
+	// by default they are only cached when they can be revalidated
+	DefaultTTL float64 `json:"defaultTTL"`
+	// ReportHits reports the responses served from the cache to the broker,
+	// costing HitCredits credits when it's set, or what the response cost.
+	ReportHits bool     `json:"reportHits"`
+	HitCredits *float64 `json:"hitCredits"`
+}
+
+// newStore creates the store of the service called name.
+func (c *CacheConf) newStore(name string) (CacheStore, error) {
+	maxSize := c.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultCacheSize
+	}
+	switch c.Store {
+	case "memory", "":
+		maxEntries := c.MaxEntries
+		if maxEntries <= 0 {
+			maxEntries = defaultCacheEntries
+		}
+		return NewMemoryCache(maxEntries, maxSize), nil
+	case "disk":
+		if c.Dir == "" {
+			return nil, fmt.Errorf("the disk cache needs a dir")
+		}
+		// services can share the dir
+		return NewDiskCache(filepath.Join(c.Dir, name), maxSize)
+	}
+	return nil, fmt.Errorf("unknown cache store %q", c.Store)
+}
+
+func (c *CacheConf) maxEntrySize() int64 {
+	if c.MaxEntrySize <= 0 {
+		return defaultCacheEntrySize
+	}
+	return c.MaxEntrySize
+}
+
+// parseCacheControl returns the directives of Cache-Control (and Pragma: no-cache).
+func parseCacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg := directive, ""
+			if i := strings.Index(directive, "="); i >= 0 {
+				name, arg = directive[:i], strings.Trim(strings.TrimSpace(directive[i+1:]), `"`)
+			}
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				directives[name] = arg
+			}
+		}
+	}
+	if header.Get("Pragma") == "no-cache" && len(directives) == 0 {
+		directives["no-cache"] = ""
+	}
+	return directives
+}
+
+func seconds(value string) (time.Duration, bool) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// freshness tells when a response was generated and until when it is fresh.
+// It's not ok when the response must not be stored.
+func (c *CacheConf) freshness(status int, header http.Header, now time.Time) (date, expires time.Time, ok bool) {
+	if !cacheableStatus[status] || header.Get("Set-Cookie") != "" || strings.Contains(header.Get("Vary"), "*") {
+		return
+	}
+	cc := parseCacheControl(header)
+	if _, noStore := cc["no-store"]; noStore {
+		return
+	}
+	if _, private := cc["private"]; private {
+		return
+	}
+
+	date = now
+	if age, valid := seconds(header.Get("Age")); valid {
+		date = now.Add(-age)
+	}
+
+	ttl := time.Duration(c.DefaultTTL * float64(time.Second))
+	if maxAge, valid := seconds(cc["s-maxage"]); valid {
+		ttl = maxAge
+	} else if maxAge, valid := seconds(cc["max-age"]); valid {
+		ttl = maxAge
+	} else if value := header.Get("Expires"); value != "" {
+		ttl = 0
+		if exp, err := http.ParseTime(value); err == nil {
+			origin := now
+			if d, err := http.ParseTime(header.Get("Date")); err == nil {
+				origin = d
+			}
+			ttl = exp.Sub(origin)
+		}
+	}
+	if _, noCache := cc["no-cache"]; noCache || ttl < 0 {
+		ttl = 0
+	}
+
+	expires = date.Add(ttl)
+	ok = ttl > 0 || canRevalidate(header)
+	return
+}
+
+func canRevalidate(header http.Header) bool {
+	return header.Get("Etag") != "" || header.Get("Last-Modified") != ""
+}
+
+func hasConditions(req *http.Request) bool {
+	return req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != ""
+}
+
+// varyHeaders lists the request headers named by Vary.
+func varyHeaders(header http.Header) (names []string) {
+	for _, value := range header["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return
+}
+
+func variantKey(key string, vary []string, header http.Header) string {
+	for _, name := range vary {
+		key += "\n" + name + ": " + strings.Join(header[name], ", ")
+	}
+	return key
+}
+
+// cacheKey identifies the document requested by req. The backends of a service serve
+// the same documents, so only the path and the query sent to them are part of it.
+func (h *ServiceHandler) cacheKey(req *http.Request) string {
+	path := h.Conf.Rewrite.rewrite(h.Path, req.URL.Path, "")
+	return h.Name + " " + path + "?" + h.Conf.Query.mergeQuery(req, "")
+}
+
+// cacheLookup returns the key of the response to req ("" when it can't be cached)
+// and the stored response, if any. A stale response must be revalidated: its
+// validators are added to req.
+// It must be called after the credentials are removed from the request.
+func (h *ServiceHandler) cacheLookup(req *http.Request) (key string, e *CacheEntry, fresh bool) {
+	if h.cache == nil || req.Method != "GET" {
+		return
+	}
+	cc := parseCacheControl(req.Header)
+	if _, noStore := cc["no-store"]; noStore {
+		return
+	}
+	key = h.cacheKey(req)
+	if _, noCache := cc["no-cache"]; noCache {
+		return
+	}
+
+	if e = h.cache.Get(key); e != nil && len(e.Vary) > 0 {
+		e = h.cache.Get(variantKey(key, e.Vary, req.Header))
+	}
+	if e == nil {
+		return
+	}
+
+	now := time.Now()
+	fresh = now.Before(e.Expires)
+	if maxAge, valid := seconds(cc["max-age"]); valid && now.Sub(e.Date) > maxAge {
+		fresh = false
+	}
+	if fresh {
+		return
+	}
+	// the conditions of the client are for the client
+	if !canRevalidate(e.Header) || hasConditions(req) {
+		return key, nil, false
+	}
+	if etag := e.Header.Get("Etag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if modified := e.Header.Get("Last-Modified"); modified != "" {
+		req.Header.Set("If-Modified-Since", modified)
+	}
+	return
+}
+
+// cacheResponse stores res when it can be cached, or refreshes the stale
+// response that it revalidates. It returns the response for the client
+// and the outcome of the lookup.
+func (h *ServiceHandler) cacheResponse(key string, stale *CacheEntry, req *http.Request, res *http.Response) (*http.Response, string) {
+	if key == "" {
+		return res, ""
+	}
+
+	now := time.Now()
+	if stale != nil && res.StatusCode == http.StatusNotModified {
+		res.Body.Close()
+		e := *stale
+		e.Header = cloneHeader(stale.Header)
+		for k, vv := range res.Header {
+			if k != "Content-Length" {
+				e.Header[k] = vv
+			}
+		}
+		var ok bool
+		if e.Date, e.Expires, ok = h.Conf.Cache.freshness(e.Status, e.Header, now); ok {
+			h.cache.Set(&e)
+		} else {
+			h.cache.Delete(e.Key)
+		}
+		res = e.response(res.Request)
+		res.Header.Set("Age", e.age())
+		return res, "revalidated"
+	}
+
+	date, expires, ok := h.Conf.Cache.freshness(res.StatusCode, res.Header, now)
+	maxSize := h.Conf.Cache.maxEntrySize()
+	if !ok || len(res.Trailer) > 0 || res.ContentLength > maxSize {
+		return res, "miss"
+	}
+
+	var buffer bytes.Buffer
+	_, err := buffer.ReadFrom(io.LimitReader(res.Body, maxSize+1))
+	if err != nil || int64(buffer.Len()) > maxSize {
+		// too big, or broken: send what was read and then the rest
+		res.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(&buffer, res.Body), res.Body}
+		return res, "miss"
+	}
+	res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewReader(buffer.Bytes()))
+	res.ContentLength = int64(buffer.Len())
+
+	e := &CacheEntry{
+		Key:     key,
+		Status:  res.StatusCode,
+		Header:  cloneHeader(res.Header),
+		Body:    buffer.Bytes(),
+		Date:    date,
+		Expires: expires,
+	}
+	if vary := varyHeaders(res.Header); len(vary) > 0 {
+		e.Vary = vary
+		e.Key = variantKey(key, vary, req.Header)
+		h.cache.Set(&CacheEntry{Key: key, Vary: vary, Date: date, Expires: expires})
+	}
+	h.cache.Set(e)
+	return res, "miss"
+}
+
+// response rebuilds the stored response, which is shared and must not be modified.
+func (e *CacheEntry) response(req *http.Request) *http.Response {
+	header := make(http.Header, len(e.Header))
+	for k, vv := range e.Header {
+		header[k] = append([]string(nil), vv...)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+}
+
+func (e *CacheEntry) age() string {
+	return strconv.Itoa(int(time.Now().Sub(e.Date).Seconds()))
+}
+
+// notModified tells if the client already has the stored response.
+func (e *CacheEntry) notModified(req *http.Request) bool {
+	if match := req.Header.Get("If-None-Match"); match != "" {
+		etag := strings.TrimPrefix(e.Header.Get("Etag"), "W/")
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if etag != "" && (candidate == etag || candidate == "*") {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	return err == nil && !modified.After(since)
+}
+
+// serveCached sends a fresh stored response, reporting it to the broker if the service wants it.
+func (h *ServiceHandler) serveCached(rw http.ResponseWriter, req *http.Request, e *CacheEntry, msg authbroker.BrokerMessage, reqData map[string]interface{}) {
+	res := e.response(req)
+	res.Header.Set("Age", e.age())
+	if e.notModified(req) {
+		res.StatusCode = http.StatusNotModified
+		res.Body = http.NoBody
+		res.ContentLength = 0
+		res.Header.Del("Content-Length")
+	}
+	reqData["type"] = "request"
+	reqData["cache"] = "hit"
+	reqData["status"] = res.StatusCode
+	logger.Infom("request served from the cache", reqData)
+
+	conf := h.Conf.Cache
+	if conf.ReportHits {
+		if conf.HitCredits != nil {
+			res.Header.Set(authbroker.CreditsHeader, strconv.FormatFloat(*conf.HitCredits, 'f', -1, 64))
+		}
+		if _, reportErr := h.Broker.Report(res, msg); reportErr != nil {
+			logger.Errorm("Report call failed, but the show must go on!", reqData)
+		}
+	} else {
+		// the hit is free (the header is written as the broker does)
+		res.Header.Del(authbroker.CreditsHeader)
+		res.Header[authbroker.CreditsHeader] = []string{"0"}
+	}
+	h.sendResponse(rw, req, res, msg, reqData)
+}
@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheEntry is a response stored in the cache.
+type CacheEntry struct {
+	Key    string      `json:"key"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+	// when the response was generated by the backend
+	Date    time.Time `json:"date"`
+	Expires time.Time `json:"expires"`
+	// the request headers the response depends on
+	Vary []string `json:"vary"`
+}
+
+func (e *CacheEntry) size() int64 {
+	size := int64(len(e.Key) + len(e.Body))
+	for k, vv := range e.Header {
+		for _, v := range vv {
+			size += int64(len(k) + len(v))
+		}
+	}
+	return size
+}
+
+// A CacheStore keeps the cached responses.
+type CacheStore interface {
+	Get(key string) *CacheEntry
+	Set(e *CacheEntry)
+	Delete(key string)
+}
+
+// MemoryCache keeps the most recently used responses in memory,
+// up to MaxEntries entries and MaxBytes bytes (when they are positive).
+type MemoryCache struct {
+	MaxEntries int
+	MaxBytes   int64
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+	size  int64
+}
+
+func NewMemoryCache(maxEntries int, maxBytes int64) *MemoryCache {
+	return &MemoryCache{
+		MaxEntries: maxEntries,
+		MaxBytes:   maxBytes,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+func (c *MemoryCache) Get(key string) *CacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		return el.Value.(*CacheEntry)
+	}
+	return nil
+}
+
+func (c *MemoryCache) Set(e *CacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[e.Key]; ok {
+		c.removeUnsafe(el)
+	}
+	c.items[e.Key] = c.ll.PushFront(e)
+	c.size += e.size()
+
+	for c.ll.Len() > 1 && ((c.MaxEntries > 0 && c.ll.Len() > c.MaxEntries) || (c.MaxBytes > 0 && c.size > c.MaxBytes)) {
+		c.removeUnsafe(c.ll.Back())
+	}
+}
+
+func (c *MemoryCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.removeUnsafe(el)
+	}
+}
+
+func (c *MemoryCache) removeUnsafe(el *list.Element) {
+	e := c.ll.Remove(el).(*CacheEntry)
+	delete(c.items, e.Key)
+	c.size -= e.size()
+}
+
+// the files of the disk cache, the others in its directory are never touched
+const diskCachePrefix = "authproxy-cache-"
+
+// DiskCache keeps the responses in Dir, one file per response. When the files take
+// more than MaxBytes bytes (and it's positive) the least recently used are removed.
+type DiskCache struct {
+	Dir      string
+	MaxBytes int64
+
+	mu   sync.Mutex
+	size int64
+}
+
+func NewDiskCache(dir string, maxBytes int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &DiskCache{Dir: dir, MaxBytes: maxBytes}
+	files, err := c.files()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		c.size += f.Size()
+	}
+	return c, nil
+}
+
+func (c *DiskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.Dir, diskCachePrefix+hex.EncodeToString(sum[:]))
+}
+
+// files lists the entries in Dir.
+func (c *DiskCache) files() (entries []os.FileInfo, err error) {
+	files, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.Mode().IsRegular() && strings.HasPrefix(f.Name(), diskCachePrefix) {
+			entries = append(entries, f)
+		}
+	}
+	return
+}
+
+func (c *DiskCache) Get(key string) *CacheEntry {
+	path := c.path(key)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var e CacheEntry
+	if err := json.Unmarshal(content, &e); err != nil || e.Key != key {
+		return nil
+	}
+	// the modification time tells which files were used last
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return &e
+}
+
+func (c *DiskCache) Set(e *CacheEntry) {
+	content, err := json.Marshal(e)
+	if err != nil {
+		logger.Warning("Can't encode cache entry: ", err.Error())
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	path := c.path(e.Key)
+	if info, err := os.Stat(path); err == nil {
+		c.size -= info.Size()
+	}
+	// readers never see half written files
+	tmp, err := ioutil.TempFile(c.Dir, "."+diskCachePrefix)
+	if err != nil {
+		logger.Warning("Can't write cache entry: ", err.Error())
+		return
+	}
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		logger.Warning("Can't write cache entry: ", err.Error())
+		return
+	}
+	c.size += int64(len(content))
+
+	if c.MaxBytes > 0 && c.size > c.MaxBytes {
+		c.evictUnsafe()
+	}
+}
+
+func (c *DiskCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	path := c.path(key)
+	if info, err := os.Stat(path); err == nil && os.Remove(path) == nil {
+		c.size -= info.Size()
+	}
+}
+
+// evictUnsafe removes the least recently used files until the cache fits in MaxBytes.
+func (c *DiskCache) evictUnsafe() {
+	files, err := c.files()
+	if err != nil {
+		logger.Warning("Can't clean the cache: ", err.Error())
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+
+	c.size = 0
+	for _, f := range files {
+		c.size += f.Size()
+	}
+	for _, f := range files {
+		if c.size <= c.MaxBytes {
+			break
+		}
+		if os.Remove(filepath.Join(c.Dir, f.Name())) == nil {
+			c.size -= f.Size()
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gigaroby/authproxy/authbroker"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultCoalesceSize = 1 << 20
+
+// the request headers that always tell apart the responses
+var coalesceHeaders = []string{"Accept", "Accept-Encoding", "Range", "If-None-Match", "If-Modified-Since"}
+
+// CoalesceConf sends only once to the backends the identical requests that are
+// in flight at the same time, sharing the response. Every request is still
+// authenticated and reported on its own, so the responses must not depend on the app.
+// The shared request is the one of the first app, so the services can't coalesce
+// when the identity of the apps is sent or the request header rules use templates.
+type CoalesceConf struct {
+	// the methods that are coalesced (GET and HEAD by default), they must be idempotent
+	Methods []string `json:"methods"`
+	// other request headers the responses depend on
+	Headers []string `json:"headers"`
+	// bigger responses are not shared (1MB by default)
+	MaxSize int64 `json:"maxSize"`
+}
+
+func (c *CoalesceConf) coalesces(method string) bool {
+	methods := c.Methods
+	if len(methods) == 0 {
+		methods = []string{"GET", "HEAD"}
+	}
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate refuses the request header rules that depend on the app or on the request,
+// since the others would get a response meant for the first one.
+func (c *CoalesceConf) validate(headers *HeadersConf) error {
+	if c == nil || headers == nil || headers.Request == nil {
+		return nil
+	}
+	for _, values := range []map[string]string{headers.Request.Set, headers.Request.Add} {
+		for name, value := range values {
+			if strings.Contains(value, "{{") {
+				return fmt.Errorf("the request header %s is a template", name)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *CoalesceConf) maxSize() int64 {
+	if c.MaxSize <= 0 {
+		return defaultCoalesceSize
+	}
+	return c.MaxSize
+}
+
+// a backend request shared by identical requests
+type flight struct {
+	done     chan struct{}
+	entry    *CacheEntry
+	backend  Service
+	duration time.Duration
+	err      error
+	// the response can't be shared, the waiting requests must go on their own
+	unshared bool
+}
+
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[string]*flight)}
+}
+
+// coalesceKey identifies the requests that can share a response, it's "" if req can't.
+func (h *ServiceHandler) coalesceKey(req *http.Request) string {
+	c := h.Conf.Coalesce
+	if c == nil || !c.coalesces(req.Method) || (req.Body != nil && req.Body != http.NoBody) {
+		return ""
+	}
+	headers := append([]string(nil), coalesceHeaders...)
+	for _, name := range c.Headers {
+		headers = append(headers, http.CanonicalHeaderKey(name))
+	}
+	return variantKey(req.Method+" "+h.cacheKey(req), headers, req.Header)
+}
+
+// roundTrip sends req to the backends, retrying when it's possible.
+func (h *ServiceHandler) roundTrip(req *http.Request, msg authbroker.BrokerMessage) (res *http.Response, backend Service, duration time.Duration, attempts int, err error) {
+	err = attempt(h.maxAttempts(req), 50*time.Millisecond, func() error {
+		if attempts > 0 && req.Context().Err() != nil {
+			return err
+		}
+		if seeker, ok := req.Body.(io.Seeker); ok {
+			seeker.Seek(0, 0)
+		}
+		attempts++
+		res, backend, duration, err = h.doProxyRequest(req, msg)
+		return err
+	})
+	return
+}
+
+// coalescedRoundTrip waits for the response of an identical request in flight,
+// or sends req to the backends sharing the response with the identical requests
+// arriving meanwhile. When the response is shared, it has been read already and
+// the backend is released.
+func (h *ServiceHandler) coalescedRoundTrip(key string, req *http.Request, msg authbroker.BrokerMessage, reqData map[string]interface{}) (res *http.Response, backend Service, duration time.Duration, attempts int, shared bool, err error) {
+	g := h.flights
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-f.done:
+		case <-req.Context().Done():
+			return nil, Service{}, 0, 0, false, req.Context().Err()
+		}
+		if f.unshared {
+			res, backend, duration, attempts, err = h.roundTrip(req, msg)
+			return
+		}
+		reqData["coalesced"] = true
+		if f.err != nil {
+			return nil, f.backend, f.duration, 0, true, f.err
+		}
+		return f.entry.response(req), f.backend, f.duration, 0, true, nil
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		delete(g.flights, key)
+		g.mu.Unlock()
+		close(f.done)
+	}()
+
+	res, backend, duration, attempts, err = h.roundTrip(req, msg)
+	f.backend, f.duration, f.err = backend, duration, err
+	if err != nil {
+		// a client going away is not a failure for the others
+		f.unshared = req.Context().Err() != nil
+		return
+	}
+
+	maxSize := h.Conf.Coalesce.maxSize()
+	var buffer bytes.Buffer
+	if res.ContentLength <= maxSize {
+		_, err = buffer.ReadFrom(io.LimitReader(res.Body, maxSize+1))
+	}
+	if res.ContentLength > maxSize || err != nil || int64(buffer.Len()) > maxSize || len(res.Trailer) > 0 {
+		// too big, or broken: send what was read and then the rest
+		f.unshared = true
+		res.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(&buffer, res.Body), res.Body}
+		return res, backend, duration, attempts, false, nil
+	}
+	res.Body.Close()
+	h.Balancer.Release(backend)
+
+	f.entry = &CacheEntry{Status: res.StatusCode, Header: cloneHeader(res.Header), Body: buffer.Bytes()}
+	return f.entry.response(req), backend, duration, attempts, true, nil
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"github.com/gigaroby/authproxy/aerrors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const defaultMinCompressSize = 1024
+
+var defaultCompressTypes = []string{"text/*", "application/json", "application/javascript", "application/xml"}
+
+// An Encoder compresses what is written to w with a content coding.
+type Encoder func(w io.Writer) io.WriteCloser
+
+var (
+	encodersMu sync.RWMutex
+	encoders   = map[string]Encoder{
+		"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+	}
+)
+
+// RegisterEncoder makes the content coding (e.g. "br") available to the services.
+// Only gzip is built in: building with -tags brotli registers "br", other programs
+// register their own encoders and list them in the encodings of the services.
+func RegisterEncoder(coding string, e Encoder) {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+	encoders[coding] = e
+}
+
+func encoderFor(coding string) Encoder {
+	encodersMu.RLock()
+	defer encodersMu.RUnlock()
+	return encoders[coding]
+}
+
+// CompressionConf compresses the responses that the backends didn't compress,
+// when the clients accept it.
+type CompressionConf struct {
+	// the content codings to use, in order of preference (only "gzip" by default),
+	// the ones other than gzip must be registered with RegisterEncoder
+	Encodings []string `json:"encodings"`
+	// media types, like "application/json" or "text/*"
+	ContentTypes []string `json:"contentTypes"`
+	// responses smaller than this (in bytes, 1024 by default) are not compressed
+	MinSize int64 `json:"minSize"`
+	// DecompressRequests inflates the gzip request bodies before the broker looks for the credentials.
+	DecompressRequests bool `json:"decompressRequests"`
+}
+
+func (c *CompressionConf) compressesType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	types := c.ContentTypes
+	if len(types) == 0 {
+		types = defaultCompressTypes
+	}
+	for _, t := range types {
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptedEncodings parses Accept-Encoding into the quality of every coding.
+func acceptedEncodings(header string) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		accepted[coding] = q
+	}
+	return accepted
+}
+
+// negotiate picks the coding to compress the response with, or "".
+func (c *CompressionConf) negotiate(acceptEncoding string) string {
+	accepted := acceptedEncodings(acceptEncoding)
+	preferred := c.Encodings
+	if len(preferred) == 0 {
+		preferred = []string{"gzip"}
+	}
+	for _, coding := range preferred {
+		q, ok := accepted[coding]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > 0 && encoderFor(coding) != nil {
+			return coding
+		}
+	}
+	return ""
+}
+
+// compressWriter compresses what is written to the client.
+type compressWriter struct {
+	http.ResponseWriter
+	enc io.WriteCloser
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	return w.enc.Write(p)
+}
+
+func (w *compressWriter) Flush() {
+	if flusher, ok := w.enc.(interface {
+		Flush() error
+	}); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// compressResponse returns where to write the body of res for the client, compressing
+// it if possible, and a function to call when the body is complete.
+// It must be called before the headers are sent.
+func (h *ServiceHandler) compressResponse(rw http.ResponseWriter, req *http.Request, res *http.Response) (http.ResponseWriter, func()) {
+	c := h.Conf.Compression
+	noop := func() {}
+	if c == nil || req.Method == "HEAD" || res.StatusCode == http.StatusNoContent || res.StatusCode == http.StatusNotModified {
+		return rw, noop
+	}
+	if res.Header.Get("Content-Encoding") != "" || !c.compressesType(res.Header.Get("Content-Type")) {
+		return rw, noop
+	}
+	// the Content-Range of a partial response counts the bytes of the identity body
+	if res.StatusCode == http.StatusPartialContent || res.Header.Get("Content-Range") != "" {
+		return rw, noop
+	}
+	minSize := c.MinSize
+	if minSize <= 0 {
+		minSize = defaultMinCompressSize
+	}
+	// an unknown length is usually a big or a streamed response
+	if res.ContentLength >= 0 && res.ContentLength < minSize {
+		return rw, noop
+	}
+
+	addVary(rw.Header(), "Accept-Encoding")
+	coding := c.negotiate(req.Header.Get("Accept-Encoding"))
+	if coding == "" {
+		return rw, noop
+	}
+
+	header := rw.Header()
+	header.Del("Content-Length")
+	header.Set("Content-Encoding", coding)
+	// the compressed body is not the same byte by byte
+	if etag := header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("Etag", "W/"+etag)
+	}
+
+	cw := &compressWriter{ResponseWriter: rw, enc: encoderFor(coding)(rw)}
+	return cw, func() { cw.enc.Close() }
+}
+
+// decompressRequest inflates a gzip request body, if the service wants it.
+func (h *ServiceHandler) decompressRequest(req *http.Request) *aerrors.ResponseError {
+	c := h.Conf.Compression
+	if c == nil || !c.DecompressRequests || req.Body == nil || !strings.EqualFold(req.Header.Get("Content-Encoding"), "gzip") {
+		return nil
+	}
+
+	body, err := gzip.NewReader(req.Body)
+	if err != nil {
+		return &aerrors.ResponseError{Message: "Invalid gzip request body", Status: 400, Code: "error.badRequest"}
+	}
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{body, req.Body}
+	req.ContentLength = -1
+	req.Header.Del("Content-Encoding")
+	req.Header.Del("Content-Length")
+	return nil
+}
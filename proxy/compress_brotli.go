@@ -0,0 +1,14 @@
+//go:build brotli
+// +build brotli
+
+package proxy
+
+import (
+	"github.com/andybalholm/brotli"
+	"io"
+)
+
+// built with -tags brotli, the services can list "br" in their encodings
+func init() {
+	RegisterEncoder("br", func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) })
+}
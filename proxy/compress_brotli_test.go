@@ -0,0 +1,36 @@
+//go:build brotli
+// +build brotli
+
+package proxy
+
+import (
+	"github.com/andybalholm/brotli"
+	. "github.com/gigaroby/authproxy/testutils"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServiceHandlerBrotli(t *testing.T) {
+	payload := strings.Repeat("hello ", 20)
+	res := NewResponse(200, payload)
+	res.ContentLength = int64(len(payload))
+	res.Header.Set("Content-Type", "text/plain")
+	conf := &ServiceConf{Path: "/service1/v1", Compression: &CompressionConf{Encodings: []string{"br", "gzip"}, MinSize: 16}}
+	h := newTestServiceHandler(conf, &FactoryTransport{Response: res})
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost/service1/v1", nil)
+	req.Header.Set("Accept-Encoding", "gzip, br")
+	h.ServeHTTP(rw, req)
+
+	if rw.Header().Get("Content-Encoding") != "br" {
+		t.Fatal("Expected a brotli response, got", rw.Header().Get("Content-Encoding"))
+	}
+	body, err := ioutil.ReadAll(brotli.NewReader(rw.Body))
+	if err != nil || string(body) != payload {
+		t.Error("Wrong brotli body:", string(body), err)
+	}
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"github.com/gigaroby/authproxy/aerrors"
+	"github.com/gigaroby/authproxy/authbroker"
+	"github.com/gigaroby/authproxy/limits"
+	"github.com/gigaroby/authproxy/requestid"
+	"net/http"
+	"time"
+)
+
+const defaultQueueTimeout = 1.0
+
+// ConcurrencyConf limits how many requests a service handles at the same time.
+// Apps share the slots in proportion to the weight of their plan (1 by default).
+type ConcurrencyConf struct {
+	MaxInFlight int `json:"maxInFlight"`
+	MaxQueue    int `json:"maxQueue"`
+	// how long (in seconds) a request can wait for a slot
+	QueueTimeout float64            `json:"queueTimeout"`
+	Plans        map[string]float64 `json:"plans"`
+	// when set, MaxInFlight is only the initial limit
+	Adaptive *AdaptiveConf `json:"adaptive"`
+}
+
+// AdaptiveConf makes the concurrency limit follow the latency of the backends.
+type AdaptiveConf struct {
+	MinLimit int `json:"minLimit"`
+	MaxLimit int `json:"maxLimit"`
+	// requests slower than this (in seconds) decrease the limit
+	LatencyThreshold float64 `json:"latencyThreshold"`
+	BackoffRatio     float64 `json:"backoffRatio"`
+}
+
+func (c *ConcurrencyConf) weightFor(plan string) float64 {
+	if weight, ok := c.Plans[plan]; ok {
+		return weight
+	}
+	return 1
+}
+
+func (c *ConcurrencyConf) queueTimeout() time.Duration {
+	timeout := c.QueueTimeout
+	if timeout <= 0 {
+		timeout = defaultQueueTimeout
+	}
+	return time.Duration(timeout * float64(time.Second))
+}
+
+func (c *ConcurrencyConf) newLimiter() (limiter *limits.ConcurrencyLimiter, adaptive *limits.AIMDLimit) {
+	if c == nil || (c.MaxInFlight <= 0 && c.Adaptive == nil) {
+		return
+	}
+	limiter = limits.NewConcurrencyLimiter(c.MaxInFlight, c.MaxQueue)
+
+	if a := c.Adaptive; a != nil {
+		threshold := time.Duration(a.LatencyThreshold * float64(time.Second))
+		adaptive = limits.NewAIMDLimit(limiter, a.MinLimit, a.MaxLimit, threshold, a.BackoffRatio)
+	}
+	return
+}
+
+// ConcurrencyStats returns the current concurrency limit of the service,
+// or nil if it has none.
+func (h *ServiceHandler) ConcurrencyStats() *limits.ConcurrencyStats {
+	if h.concurrency == nil {
+		return nil
+	}
+	inFlight, queued := h.concurrency.Stats()
+	return &limits.ConcurrencyStats{
+		Limit:    h.concurrency.Limit(),
+		InFlight: inFlight,
+		Queued:   queued,
+		Adaptive: h.adaptive != nil,
+	}
+}
+
+// observeLatency feeds the adaptive limit with the outcome of every attempt
+// of a backend request.
+func (h *ServiceHandler) observeLatency(d time.Duration, failed bool) {
+	if h.adaptive != nil {
+		h.adaptive.Observe(d, failed)
+	}
+}
+
+// acquireSlot waits for the service to be able to handle another request of the app.
+func (h *ServiceHandler) acquireSlot(req *http.Request, msg authbroker.BrokerMessage) (release func(), err *aerrors.ResponseError) {
+	if h.concurrency == nil {
+		return func() {}, nil
+	}
+
+	release, acquireErr := h.concurrency.Acquire(req.Context(), msg["appId"], h.Conf.Concurrency.weightFor(msg["plan"]), h.Conf.Concurrency.queueTimeout())
+	if acquireErr != nil {
+		logger.Infom("Request refused", map[string]interface{}{
+			"request_id": requestid.FromContext(req.Context()),
+			"app_id":     msg["appId"],
+			"error":      acquireErr.Error(),
+		})
+		err = &aerrors.ResponseError{
+			Message: "the service is overloaded, try again later",
+			Status:  http.StatusServiceUnavailable,
+			Code:    "error.overloaded",
+		}
+	}
+	return
+}
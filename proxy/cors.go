@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/gigaroby/authproxy/aerrors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var defaultCORSMethods = []string{"GET", "HEAD", "POST"}
+
+// CORSConf lets browsers call a service from other origins.
+// http://www.w3.org/TR/cors/
+type CORSConf struct {
+	// AllowedOrigins are origins like "https://example.com", "https://*.example.com" or "*".
+	AllowedOrigins []string `json:"allowedOrigins"`
+	// GET, HEAD and POST by default
+	AllowedMethods []string `json:"allowedMethods"`
+	// "*" allows all the headers the browsers ask for
+	AllowedHeaders   []string `json:"allowedHeaders"`
+	ExposedHeaders   []string `json:"exposedHeaders"`
+	AllowCredentials bool     `json:"allowCredentials"`
+	// how long (in seconds) the browsers can cache the preflight responses
+	MaxAge float64 `json:"maxAge"`
+}
+
+// validate refuses to let any website make credentialed calls.
+func (c *CORSConf) validate() error {
+	if c == nil || !c.AllowCredentials {
+		return nil
+	}
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" {
+			return fmt.Errorf("credentials can't be allowed for all the origins")
+		}
+	}
+	return nil
+}
+
+func (c *CORSConf) allowsOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		// https://*.example.com
+		if i := strings.Index(allowed, "*."); i >= 0 {
+			if strings.HasPrefix(origin, allowed[:i]) && strings.HasSuffix(origin, allowed[i+1:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *CORSConf) allowsMethod(method string) bool {
+	methods := c.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	for _, allowed := range methods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORSConf) allowsHeaders(requested string) bool {
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+		found := false
+		for _, allowed := range c.AllowedHeaders {
+			if allowed == "*" || strings.EqualFold(allowed, header) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// addVary adds value to the Vary header, unless it's there already.
+func addVary(header http.Header, value string) {
+	for _, v := range header["Vary"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), value) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", value)
+}
+
+func isPreflight(req *http.Request) bool {
+	return req.Method == "OPTIONS" && req.Header.Get("Origin") != "" && req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// corsHeaders adds the CORS headers for the origin of req, if it's allowed,
+// replacing the ones of the backend.
+func (h *ServiceHandler) corsHeaders(header http.Header, req *http.Request) {
+	c := h.Conf.CORS
+	if c == nil {
+		return
+	}
+	for name := range header {
+		if strings.HasPrefix(http.CanonicalHeaderKey(name), "Access-Control-") {
+			delete(header, name)
+		}
+	}
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+
+	addVary(header, "Origin")
+	if !c.allowsOrigin(origin) {
+		return
+	}
+	header.Set("Access-Control-Allow-Origin", origin)
+	if c.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(c.ExposedHeaders) > 0 {
+		header.Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+	}
+}
+
+// servePreflight answers a preflight request without asking the broker,
+// which could not authenticate it anyway.
+func (h *ServiceHandler) servePreflight(rw http.ResponseWriter, req *http.Request) int {
+	c := h.Conf.CORS
+	method := req.Header.Get("Access-Control-Request-Method")
+	requestedHeaders := req.Header.Get("Access-Control-Request-Headers")
+
+	if !c.allowsOrigin(req.Header.Get("Origin")) || !c.allowsMethod(method) || !c.allowsHeaders(requestedHeaders) {
+		addVary(rw.Header(), "Origin")
+		writeError(rw, aerrors.ResponseError{Message: "Cross-origin request not allowed", Status: 403, Code: "error.corsForbidden"})
+		return 403
+	}
+
+	h.corsHeaders(rw.Header(), req)
+	rw.Header().Set("Access-Control-Allow-Methods", method)
+	if requestedHeaders != "" {
+		rw.Header().Set("Access-Control-Allow-Headers", requestedHeaders)
+	}
+	if c.MaxAge > 0 {
+		rw.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge)))
+	}
+	rw.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// flushInterval tells how often the response of the backend is flushed to the client:
+// 0 never (until the end), negative after every write.
+func (h *ServiceHandler) flushInterval(res *http.Response) time.Duration {
+	// server-sent events are useless if they are late
+	if mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type")); err == nil && mediaType == "text/event-stream" {
+		return -1
+	}
+	if h.Conf.FlushInterval < 0 {
+		return -1
+	}
+	return time.Duration(h.Conf.FlushInterval * float64(time.Second))
+}
+
+// copyResponse sends the body and the trailers of the response of the backend to the client.
+func (h *ServiceHandler) copyResponse(rw http.ResponseWriter, res *http.Response) (err error) {
+	var dst io.Writer = rw
+	if interval := h.flushInterval(res); interval != 0 {
+		if flusher, ok := rw.(http.Flusher); ok {
+			fw := &flushWriter{dst: rw, flusher: flusher, interval: interval}
+			defer fw.stop()
+			dst = fw
+		}
+	}
+
+	_, err = io.Copy(dst, res.Body)
+
+	// the trailers are known only after the body has been read
+	for k, vv := range res.Trailer {
+		rw.Header()[k] = vv
+	}
+	return
+}
+
+// announceTrailers declares the trailers of the backend response,
+// that must be known before the headers are sent.
+func announceTrailers(dst http.Header, trailer http.Header) {
+	for k := range trailer {
+		dst.Add("Trailer", k)
+	}
+}
+
+// flushWriter flushes what's written to it at most after interval,
+// or right away when interval is negative.
+type flushWriter struct {
+	dst      io.Writer
+	flusher  http.Flusher
+	interval time.Duration
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	pending bool
+	stopped bool
+}
+
+func (w *flushWriter) Write(p []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	n, err = w.dst.Write(p)
+	if w.interval < 0 {
+		w.flusher.Flush()
+		return
+	}
+
+	if w.pending {
+		return
+	}
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.interval, w.delayedFlush)
+	} else {
+		w.timer.Reset(w.interval)
+	}
+	w.pending = true
+	return
+}
+
+func (w *flushWriter) delayedFlush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.pending || w.stopped {
+		return
+	}
+	w.flusher.Flush()
+	w.pending = false
+}
+
+func (w *flushWriter) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopped = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
@@ -6,16 +6,51 @@ package proxy
 
 import (
 	"encoding/json"
+	"github.com/gigaroby/authproxy/accesslog"
 	"github.com/gigaroby/authproxy/aerrors"
 	"github.com/gigaroby/authproxy/authbroker"
+	"github.com/gigaroby/authproxy/identity"
+	"github.com/gigaroby/authproxy/limits"
 	gorillamux "github.com/gorilla/mux"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"time"
 )
 
 type ServiceConf struct {
-	Path string `json:"path"`
+	Path        string           `json:"path"`
+	RateLimit   *RateLimitConf   `json:"rateLimit"`
+	Concurrency *ConcurrencyConf `json:"concurrency"`
+	Body        *BodyConf        `json:"body"`
+	Upgrade     *UpgradeConf     `json:"upgrade"`
+	Rewrite     *RewriteConf     `json:"rewrite"`
+	Query       *QueryConf       `json:"query"`
+	Headers     *HeadersConf     `json:"headers"`
+	Redirects   *RedirectConf    `json:"redirects"`
+	CORS        *CORSConf        `json:"cors"`
+	Compression *CompressionConf `json:"compression"`
+	Cache       *CacheConf       `json:"cache"`
+	Coalesce    *CoalesceConf    `json:"coalesce"`
+	Mirror      *MirrorConf      `json:"mirror"`
+	// the scopes of the plans, sent to the backends with the identity of the apps
+	// when the broker doesn't know them
+	Scopes map[string][]string `json:"scopes"`
+	// how often (in seconds) the responses are flushed while they're read from the backend,
+	// negative to flush every write
+	FlushInterval float64 `json:"flushInterval"`
+}
+
+// Options holds the optional dependencies of the proxy handler.
+type Options struct {
+	// RateLimitStore shares the rate limit counters between proxy instances.
+	// When nil, every instance enforces its own limits.
+	RateLimitStore limits.Store
+	// AccessLog, when set, gets an entry for every proxied request
+	// (not for the 404s of the requests matching no service).
+	AccessLog *accesslog.Logger
+	// Identity, when set, signs the identity of the apps in the requests to the backends.
+	Identity identity.Signer
 }
 
 type NotFoundHandler struct{}
@@ -30,11 +65,162 @@ func (h *NotFoundHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	writeError(rw, err)
 }
 
-func NewProxyHandler(b authbroker.AuthenticationBroker, t http.RoundTripper, servicesFile, backendsFile string) http.Handler {
+// ProxyHandler routes the requests to the handler of the right service.
+type ProxyHandler struct {
+	Services map[string]*ServiceHandler
+	mux      *gorillamux.Router
+	overlays map[string]*OverlayDiscoverer
+}
+
+func (p *ProxyHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	p.mux.ServeHTTP(rw, req)
+}
+
+// MatchService tells if req goes to one of the services, which limit the bodies on their own.
+func (p *ProxyHandler) MatchService(req *http.Request) bool {
+	var match gorillamux.RouteMatch
+	return p.mux.Match(req, &match) && match.MatchErr == nil
+}
+
+// ConcurrencyLimits returns the current concurrency limit of every service that has one.
+func (p *ProxyHandler) ConcurrencyLimits() map[string]*limits.ConcurrencyStats {
+	stats := make(map[string]*limits.ConcurrencyStats)
+	for name, sh := range p.Services {
+		if s := sh.ConcurrencyStats(); s != nil {
+			stats[name] = s
+		}
+	}
+	return stats
+}
+
+// Backends returns the state of the backends of every service.
+func (p *ProxyHandler) Backends() map[string][]BackendStatus {
+	backends := make(map[string][]BackendStatus)
+	for name, sh := range p.Services {
+		backends[name] = sh.Balancer.Backends()
+	}
+	return backends
+}
+
+func (p *ProxyHandler) service(name string) (*ServiceHandler, error) {
+	sh, ok := p.Services[name]
+	if !ok {
+		return nil, aerrors.ResponseError{Status: 404, Message: "Unknown service " + name, Code: "error.notFound"}
+	}
+	return sh, nil
+}
+
+func parseBackend(rawurl string) (Service, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return Service{}, aerrors.ResponseError{Status: 400, Message: "Invalid backend URL: " + rawurl, Code: "error.badRequest"}
+	}
+	return Service(*u), nil
+}
+
+func hasBackend(backends []BackendStatus, backend Service) bool {
+	for _, status := range backends {
+		if status.URL == backend.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// othersServing counts the backends other than backend that get new requests.
+func othersServing(backends []BackendStatus, backend Service) (serving int) {
+	for _, status := range backends {
+		if !status.Draining && status.URL != backend.String() {
+			serving++
+		}
+	}
+	return
+}
+
+// AddBackend starts sending the requests of a service to the backend at rawurl.
+func (p *ProxyHandler) AddBackend(service, rawurl string) error {
+	sh, err := p.service(service)
+	if err != nil {
+		return err
+	}
+	backend, err := parseBackend(rawurl)
+	if err != nil {
+		return err
+	}
+
+	p.overlays[service].Add(backend)
+	// it may have been drained and removed with requests still in flight
+	sh.Balancer.Undrain(backend)
+	sh.Balancer.Refresh()
+	logger.Infom("backend added", map[string]interface{}{"service": service, "backend": backend.String()})
+	return nil
+}
+
+// RemoveBackend stops sending the requests of a service to the backend at rawurl.
+// The requests in flight are not affected.
+func (p *ProxyHandler) RemoveBackend(service, rawurl string) error {
+	sh, err := p.service(service)
+	if err != nil {
+		return err
+	}
+	backend, err := parseBackend(rawurl)
+	if err != nil {
+		return err
+	}
+
+	backends := sh.Balancer.Backends()
+	if !hasBackend(backends, backend) {
+		return aerrors.ResponseError{Status: 404, Message: "Unknown backend " + rawurl, Code: "error.notFound"}
+	}
+	if othersServing(backends, backend) == 0 {
+		return aerrors.ResponseError{Status: 409, Message: "Can't remove the last backend of " + service, Code: "error.conflict"}
+	}
+
+	p.overlays[service].Remove(backend)
+	sh.Balancer.Refresh()
+	logger.Infom("backend removed", map[string]interface{}{"service": service, "backend": backend.String()})
+	return nil
+}
+
+// DrainBackend stops sending new requests of a service to the backend at rawurl,
+// which can be removed when its requests in flight are completed.
+func (p *ProxyHandler) DrainBackend(service, rawurl string) error {
+	sh, err := p.service(service)
+	if err != nil {
+		return err
+	}
+	backend, err := parseBackend(rawurl)
+	if err != nil {
+		return err
+	}
+
+	backends := sh.Balancer.Backends()
+	if !hasBackend(backends, backend) {
+		return aerrors.ResponseError{Status: 404, Message: "Unknown backend " + rawurl, Code: "error.notFound"}
+	}
+	if othersServing(backends, backend) == 0 {
+		return aerrors.ResponseError{Status: 409, Message: "Can't drain the last backend of " + service, Code: "error.conflict"}
+	}
+
+	sh.Balancer.Drain(backend)
+	logger.Infom("backend draining", map[string]interface{}{"service": service, "backend": backend.String()})
+	return nil
+}
+
+func NewProxyHandler(b authbroker.AuthenticationBroker, t http.RoundTripper, servicesFile, backendsFile string, opts *Options) *ProxyHandler {
 	if t == nil {
 		t = http.DefaultTransport
 	}
 
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	var limiter limits.Limiter = limits.NewRateLimiter()
+	if opts.RateLimitStore != nil {
+		limiter = limits.NewSlidingWindowLimiter(opts.RateLimitStore)
+	}
+
 	if b == nil {
 		b = &authbroker.YesBroker{}
 	}
@@ -51,16 +237,36 @@ func NewProxyHandler(b authbroker.AuthenticationBroker, t http.RoundTripper, ser
 
 	mux := gorillamux.NewRouter()
 	mux.NotFoundHandler = &NotFoundHandler{}
+	handlers := make(map[string]*ServiceHandler)
+	overlays := make(map[string]*OverlayDiscoverer)
 
 	for k, v := range services {
-		d := &JsonDiscoverer{Path: backendsFile, Name: k}
+		d := NewOverlayDiscoverer(&JsonDiscoverer{Path: backendsFile, Name: k})
+		overlays[k] = d
 		lb := NewLoadBalancer(d, &RandomRouter{}, time.Duration(1)*time.Second)
+		lb.Name = k
 		lb.Start()
 		sh := NewServiceHandler(k, &v, t, b, lb)
+		sh.Limiter = limiter
+		sh.AccessLog = opts.AccessLog
+		sh.Identity = opts.Identity
+		if v.Coalesce != nil && opts.Identity != nil {
+			logger.Fatal("Invalid coalesce configuration for ", k, ": the requests are signed with the identity of the apps")
+		}
+		if v.Mirror != nil {
+			d, err := v.Mirror.discoverer(backendsFile)
+			if err != nil {
+				logger.Fatal("Invalid mirror configuration for ", k, ": ", err.Error())
+			}
+			sh.Shadow = NewLoadBalancer(d, &RandomRouter{}, time.Duration(1)*time.Second)
+			sh.Shadow.Name = k + "-shadow"
+			sh.Shadow.Start()
+		}
 		sh.Register(mux)
+		handlers[k] = sh
 	}
 
-	return mux
+	return &ProxyHandler{Services: handlers, mux: mux, overlays: overlays}
 }
 
 func copyHeader(dst, src http.Header) {
@@ -69,11 +275,4 @@ func copyHeader(dst, src http.Header) {
 		// NOTE: don't use Add here, it doesn't preserve the case: https://code.google.com/p/go/issues/detail?id=5022
 		dst[k] = vv
 	}
-	for _, k := range []string{"X-DL-Count", "X-DL-datagem-version"} {
-		s := dst.Get(k)
-		if s != "" {
-			dst.Del(k)
-			dst[k] = []string{s}
-		}
-	}
 }
@@ -1,13 +1,29 @@
 package proxy
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
+	"github.com/gigaroby/authproxy/aerrors"
+	"github.com/gigaroby/authproxy/authbroker"
+	"github.com/gigaroby/authproxy/identity"
+	"github.com/gigaroby/authproxy/metrics"
 	. "github.com/gigaroby/authproxy/testutils"
 	. "github.com/smartystreets/goconvey/convey"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestCopyHeader(t *testing.T) {
@@ -31,7 +47,7 @@ func TestCopyHeader(t *testing.T) {
 
 func TestProxyHandlerPaths(t *testing.T) {
 	trans := &RecordTransport{}
-	proxy := NewProxyHandler(nil, trans, "test_data/services.json", "test_data/backends.json")
+	proxy := NewProxyHandler(nil, trans, "test_data/services.json", "test_data/backends.json", nil)
 
 	Convey("Given a user that queries an API endpoint", t, func() {
 		Convey("When he asks a not existent endpoint", func() {
@@ -52,6 +68,9 @@ func TestProxyHandlerPaths(t *testing.T) {
 				So(v["error"], ShouldEqual, true)
 				So(v["code"], ShouldEqual, "error.notFound")
 			})
+			Convey("It doesn't match any service", func() {
+				So(proxy.MatchService(req), ShouldBeFalse)
+			})
 		})
 
 		Convey("When he GETs the right URL", func() {
@@ -62,6 +81,7 @@ func TestProxyHandlerPaths(t *testing.T) {
 				url := trans.LastRequest.URL
 				So(url.Host, ShouldEqual, "example.com")
 				So(url.Path, ShouldEqual, "/service1")
+				So(proxy.MatchService(req), ShouldBeTrue)
 			})
 		})
 
@@ -95,7 +115,7 @@ func TestProxyHandlerBackendErrors(t *testing.T) {
 	Convey("Given a user that queries an API endpoint", t, func() {
 		Convey("When he GETs a service with a backend that returns a 3xx", func() {
 			trans := &FactoryTransport{Response: NewResponse(301, "")}
-			proxy := NewProxyHandler(nil, trans, "test_data/services.json", "test_data/backends.json")
+			proxy := NewProxyHandler(nil, trans, "test_data/services.json", "test_data/backends.json", nil)
 
 			Convey("He gets an error", func() {
 				rw := httptest.NewRecorder()
@@ -114,3 +134,1103 @@ func TestProxyHandlerBackendErrors(t *testing.T) {
 		})
 	})
 }
+
+func TestProxyHandlerRateLimit(t *testing.T) {
+	trans := &FactoryTransport{Response: NewResponse(200, "")}
+	proxy := NewProxyHandler(nil, trans, "test_data/services.json", "test_data/backends.json", nil)
+
+	Convey("Given a service with a rate limit", t, func() {
+		Convey("When an app sends more requests than its burst", func() {
+			var rw *httptest.ResponseRecorder
+			for i := 0; i < 3; i++ {
+				rw = httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", "http://localhost/service3/v1", nil)
+				proxy.ServeHTTP(rw, req)
+			}
+
+			Convey("He gets a 429 telling him when to retry", func() {
+				So(rw.Code, ShouldEqual, 429)
+				So(rw.Header().Get("Retry-After"), ShouldNotEqual, "")
+				So(rw.Header().Get("RateLimit-Limit"), ShouldEqual, "2")
+				So(rw.Header().Get("RateLimit-Remaining"), ShouldEqual, "0")
+
+				var v map[string]interface{}
+				content, _ := ioutil.ReadAll(rw.Body)
+				err := json.Unmarshal(content, &v)
+
+				So(err, ShouldBeNil)
+				So(v["code"], ShouldEqual, "error.rateLimited")
+			})
+		})
+	})
+}
+
+func TestProxyHandlerRequestId(t *testing.T) {
+	trans := &RecordTransport{}
+	proxy := NewProxyHandler(nil, trans, "test_data/services.json", "test_data/backends.json", nil)
+
+	Convey("Given a user that queries an API endpoint", t, func() {
+		Convey("When he sends a request id", func() {
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "http://localhost/service1/v1", nil)
+			req.Header.Set("X-Request-Id", "my-request")
+			proxy.ServeHTTP(rw, req)
+
+			Convey("It is passed to the backend and returned to him", func() {
+				So(trans.LastRequest.Header.Get("X-Request-Id"), ShouldEqual, "my-request")
+				So(rw.Header().Get("X-Request-Id"), ShouldEqual, "my-request")
+			})
+		})
+
+		Convey("When he doesn't send a request id and gets an error", func() {
+			proxy := NewProxyHandler(nil, &FactoryTransport{Response: NewResponse(301, "")}, "test_data/services.json", "test_data/backends.json", nil)
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "http://localhost/service1/v1", nil)
+			proxy.ServeHTTP(rw, req)
+
+			Convey("The error contains a generated request id", func() {
+				var v map[string]interface{}
+				content, _ := ioutil.ReadAll(rw.Body)
+				json.Unmarshal(content, &v)
+
+				So(rw.Header().Get("X-Request-Id"), ShouldNotEqual, "")
+				So(v["requestId"], ShouldEqual, rw.Header().Get("X-Request-Id"))
+			})
+		})
+	})
+}
+
+func TestProxyHandlerBackends(t *testing.T) {
+	trans := &RecordTransport{}
+	proxy := NewProxyHandler(nil, trans, "test_data/services.json", "test_data/backends.json", nil)
+
+	send := func() string {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost/service2/v1", nil)
+		proxy.ServeHTTP(rw, req)
+		return trans.LastRequest.URL.Host
+	}
+
+	Convey("Given a service with one backend", t, func() {
+		Convey("Unknown services, bad URLs and removing or draining the last backend are refused", func() {
+			So(proxy.Backends()["service2"], ShouldHaveLength, 1)
+			So(proxy.AddBackend("service100", "http://other.com/"), ShouldNotBeNil)
+			So(proxy.AddBackend("service2", "other.com"), ShouldNotBeNil)
+			So(proxy.RemoveBackend("service2", "https://example.com/service2"), ShouldNotBeNil)
+			So(proxy.DrainBackend("service2", "https://example.com/service2"), ShouldNotBeNil)
+		})
+
+		Convey("When a backend is added and the old one drained", func() {
+			So(proxy.AddBackend("service2", "https://other.com/service2"), ShouldBeNil)
+			So(proxy.DrainBackend("service2", "https://example.com/service2"), ShouldBeNil)
+
+			Convey("The requests go to the new backend right away", func() {
+				for i := 0; i < 5; i++ {
+					So(send(), ShouldEqual, "other.com")
+				}
+
+				backends := proxy.Backends()["service2"]
+				So(backends, ShouldHaveLength, 2)
+				So(backends[0].Drained, ShouldBeTrue)
+			})
+
+			Convey("The only serving backend can't be removed", func() {
+				err := proxy.RemoveBackend("service2", "https://other.com/service2")
+				So(err, ShouldNotBeNil)
+				So(err.(aerrors.ResponseError).Status, ShouldEqual, 409)
+			})
+
+			Convey("The drained backend can be removed", func() {
+				// a request still in flight
+				old, _ := parseBackend("https://example.com/service2")
+				balancer := proxy.Services["service2"].Balancer
+				balancer.Acquire(old)
+				defer balancer.Release(old)
+
+				So(proxy.RemoveBackend("service2", "https://example.com/service2"), ShouldBeNil)
+				So(proxy.Backends()["service2"], ShouldHaveLength, 1)
+
+				Convey("And added again, serving new requests", func() {
+					So(proxy.AddBackend("service2", "https://example.com/service2"), ShouldBeNil)
+					for _, status := range proxy.Backends()["service2"] {
+						So(status.Draining, ShouldBeFalse)
+					}
+				})
+			})
+		})
+	})
+}
+
+// a http.RoundTripper that reads the request bodies and fails
+type failingTransport struct {
+	Bodies []string
+}
+
+func (t *failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	t.Bodies = append(t.Bodies, string(body))
+	return nil, errors.New("connection refused")
+}
+
+func TestProxyHandlerStreamedBody(t *testing.T) {
+	Convey("Given a service streaming the request bodies", t, func() {
+		trans := &failingTransport{}
+		proxy := NewProxyHandler(nil, trans, "test_data/services.json", "test_data/backends.json", nil)
+		post := func(body string) *httptest.ResponseRecorder {
+			rw := httptest.NewRecorder()
+			// hide the length, as a chunked request would
+			req, _ := http.NewRequest("POST", "http://localhost/service4/v1", ioutil.NopCloser(strings.NewReader(body)))
+			proxy.ServeHTTP(rw, req)
+			return rw
+		}
+
+		Convey("When the body is bigger than the limit", func() {
+			rw := post(strings.Repeat("x", 32))
+
+			Convey("He gets an error and not a bad gateway", func() {
+				var v map[string]interface{}
+				content, _ := ioutil.ReadAll(rw.Body)
+				json.Unmarshal(content, &v)
+
+				So(rw.Code, ShouldEqual, 400)
+				So(v["code"], ShouldEqual, "error.requestTooLarge")
+			})
+		})
+
+		Convey("When the body fits in the retry buffer", func() {
+			post("hello")
+
+			Convey("The request is retried with the whole body", func() {
+				So(trans.Bodies, ShouldResemble, []string{"hello", "hello", "hello"})
+			})
+		})
+
+		Convey("When the body doesn't fit in the retry buffer", func() {
+			rw := post("hello world!")
+
+			Convey("The request is sent only once", func() {
+				So(rw.Code, ShouldEqual, 502)
+				So(trans.Bodies, ShouldResemble, []string{"hello world!"})
+			})
+		})
+	})
+}
+
+func TestProxyHandlerUpgrade(t *testing.T) {
+	// a backend echoing the lines sent after the upgrade
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Upgrade") != "echo" || req.URL.Path != "/service5" {
+			rw.WriteHeader(400)
+			return
+		}
+		conn, buf, _ := rw.(http.Hijacker).Hijack()
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		buf.Flush()
+		for {
+			line, err := buf.ReadString('\n')
+			if err != nil {
+				return
+			}
+			buf.WriteString(line)
+			buf.Flush()
+		}
+	}))
+	defer backend.Close()
+
+	proxy := NewProxyHandler(nil, nil, "test_data/services.json", "test_data/backends.json", nil)
+	proxy.Services["service5"].Dial = func(network, addr string) (net.Conn, error) {
+		return net.Dial(network, backend.Listener.Addr().String())
+	}
+	front := httptest.NewServer(proxy)
+	defer front.Close()
+
+	Convey("Given a service accepting protocol upgrades", t, func() {
+		conn, err := net.Dial("tcp", front.Listener.Addr().String())
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+
+		Convey("When he asks to upgrade the connection", func() {
+			conn.Write([]byte("GET /service5/v1 HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+			res, err := http.ReadResponse(reader, nil)
+			So(err, ShouldBeNil)
+
+			Convey("The connection is spliced to the backend", func() {
+				So(res.StatusCode, ShouldEqual, 101)
+				So(res.Header.Get("X-Request-Id"), ShouldNotEqual, "")
+
+				conn.Write([]byte("hello\n"))
+				line, err := reader.ReadString('\n')
+				So(err, ShouldBeNil)
+				So(line, ShouldEqual, "hello\n")
+			})
+		})
+	})
+}
+
+// a http.RoundTripper sending all the requests to addr
+type redirectTransport struct {
+	addr string
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.Scheme = "http"
+	req.URL.Host = t.addr
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestProxyHandlerStreamedResponse(t *testing.T) {
+	release := make(chan bool, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		rw.Header().Set("Trailer", "X-Checksum")
+		rw.WriteHeader(200)
+		rw.Write([]byte("data: one\n\n"))
+		rw.(http.Flusher).Flush()
+		// don't hang when the events are not flushed
+		select {
+		case <-release:
+		case <-time.After(3 * time.Second):
+		}
+		rw.Write([]byte("data: two\n\n"))
+		rw.Header().Set("X-Checksum", "42")
+	}))
+	defer backend.Close()
+
+	proxy := NewProxyHandler(nil, &redirectTransport{backend.Listener.Addr().String()}, "test_data/services.json", "test_data/backends.json", nil)
+	front := httptest.NewServer(proxy)
+	defer front.Close()
+
+	Convey("Given a backend sending server-sent events", t, func() {
+		type event struct {
+			res    *http.Response
+			reader *bufio.Reader
+			line   string
+		}
+		events := make(chan event, 1)
+		go func() {
+			res, err := http.Get(front.URL + "/service1/v1")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			reader := bufio.NewReader(res.Body)
+			line, _ := reader.ReadString('\n')
+			events <- event{res, reader, line}
+		}()
+
+		Convey("The events reach the client while the backend is still sending", func() {
+			var first event
+			select {
+			case first = <-events:
+			case <-time.After(2 * time.Second):
+				first = <-events
+				t.Error("The first event was not flushed")
+			}
+			defer first.res.Body.Close()
+			So(first.line, ShouldEqual, "data: one\n")
+			release <- true
+
+			Convey("And the trailers are forwarded at the end", func() {
+				rest, _ := ioutil.ReadAll(first.reader)
+				So(string(rest), ShouldEqual, "\ndata: two\n\n")
+				So(first.res.Trailer.Get("X-Checksum"), ShouldEqual, "42")
+			})
+		})
+	})
+}
+
+func TestServiceHandlerRewrite(t *testing.T) {
+	backend, _ := url.Parse("http://example.com/service1")
+	cases := []struct {
+		rewrite  *RewriteConf
+		path     string
+		expected string
+	}{
+		{nil, "/service1/v1/foo", "/service1"},
+		{&RewriteConf{PreserveSubPath: true}, "/service1/v1/foo/bar", "/service1/foo/bar"},
+		{&RewriteConf{PreserveSubPath: true}, "/service1/v1", "/service1"},
+		{&RewriteConf{StripPrefix: "/service1"}, "/service1/v1/foo", "/service1/v1/foo"},
+		{&RewriteConf{PreserveSubPath: true, AddPrefix: "/api"}, "/service1/v1/foo", "/service1/api/foo"},
+		{&RewriteConf{Regex: `^/service1/v(\d+)/items/(\w+)$`, Replacement: "/items/$2/version/$1"}, "/service1/v1/items/abc", "/service1/items/abc/version/1"},
+	}
+
+	for i, c := range cases {
+		h := NewServiceHandler("service1", &ServiceConf{Path: "/service1/v1", Rewrite: c.rewrite}, nil, nil, nil)
+		req, _ := http.NewRequest("GET", "http://localhost"+c.path, nil)
+		out := h.requestToProxy(req, Service(*backend))
+		if out.URL.Path != c.expected {
+			t.Errorf("Case %d: expected %s, got %s", i, c.expected, out.URL.Path)
+		}
+	}
+}
+
+func TestProxyHandlerRewrite(t *testing.T) {
+	Convey("Given a service rewriting the paths", t, func() {
+		trans := &RecordTransport{}
+		proxy := NewProxyHandler(nil, trans, "test_data/services.json", "test_data/backends.json", nil)
+
+		Convey("Its sub-paths are routed to the backend", func() {
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "http://localhost/service6/v1/foo/bar", nil)
+			proxy.ServeHTTP(rw, req)
+
+			So(trans.LastRequest, ShouldNotBeNil)
+			So(trans.LastRequest.URL.Path, ShouldEqual, "/service6/foo/bar")
+		})
+
+		Convey("The sub-paths of the other services are not found", func() {
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "http://localhost/service1/v1/foo", nil)
+			proxy.ServeHTTP(rw, req)
+
+			So(rw.Code, ShouldEqual, 404)
+			So(trans.LastRequest, ShouldBeNil)
+		})
+	})
+}
+
+func TestServiceHandlerQuery(t *testing.T) {
+	cases := []struct {
+		query    *QueryConf
+		client   string
+		backend  string
+		expected string
+	}{
+		{nil, "b=2&a=1", "", "b=2&a=1"},
+		{nil, "tenant=other&a=1", "tenant=acme&version=2", "a=1&tenant=acme&version=2"},
+		{&QueryConf{Precedence: "client"}, "version=3", "version=2", "version=3"},
+		{&QueryConf{Precedence: "append"}, "version=3", "version=2", "version=3&version=2"},
+		{&QueryConf{Strip: []string{"debug"}}, "debug=1&a=1", "", "a=1"},
+	}
+
+	for i, c := range cases {
+		backend, _ := url.Parse("http://example.com/service1?" + c.backend)
+		h := NewServiceHandler("service1", &ServiceConf{Path: "/service1/v1", Query: c.query}, nil, nil, nil)
+		req, _ := http.NewRequest("GET", "http://localhost/service1/v1?"+c.client, nil)
+		out := h.requestToProxy(req, Service(*backend))
+		if out.URL.RawQuery != c.expected {
+			t.Errorf("Case %d: expected %s, got %s", i, c.expected, out.URL.RawQuery)
+		}
+	}
+}
+
+// a broker authorizing everything for a gold app
+type goldBroker struct{}
+
+func (b *goldBroker) Authenticate(req *http.Request) (bool, authbroker.BrokerMessage, *aerrors.ResponseError) {
+	return true, authbroker.BrokerMessage{"appId": "MyApp", "plan": "Gold", "providerKey": "secret"}, nil
+}
+
+func (b *goldBroker) Report(res *http.Response, msg authbroker.BrokerMessage) (chan bool, error) {
+	return nil, nil
+}
+
+func newTestServiceHandler(conf *ServiceConf, t http.RoundTripper) *ServiceHandler {
+	backend, _ := url.Parse("http://example.com/service1")
+	lb := NewLoadBalancer(&StaticDiscoverer{Services: []Service{Service(*backend)}}, &RandomRouter{}, time.Second)
+	lb.Start()
+	return NewServiceHandler("service1", conf, t, &goldBroker{}, lb)
+}
+
+func TestServiceHandlerHeaders(t *testing.T) {
+	res := NewResponse(200, "")
+	res.Header.Set("X-Internal-Host", "10.0.0.1")
+	res.Header.Set("X-Old", "value")
+	res.Header.Set("X-DL-Count", "3")
+	trans := &RecordTransport{}
+	conf := &ServiceConf{
+		Path: "/service1/v1",
+		Headers: &HeadersConf{
+			Request: &HeaderRules{
+				Remove: []string{"Cookie"},
+				Set:    map[string]string{"X-App-Id": "{{.appId}}", "X-Plan": "{{.plan}}", "X-Missing": "{{.scopes}}"},
+			},
+			Response: &HeaderRules{
+				Rename: map[string]string{"X-Old": "X-New"},
+				Remove: []string{"X-Internal-Host"},
+				Set:    map[string]string{"X-DL-plan": "{{.plan}}", "X-Provider-Key": "{{.providerKey}}"},
+				Add:    map[string]string{"X-Served-By": "{{.service}}"},
+			},
+		},
+	}
+
+	Convey("Given a service with header rules", t, func() {
+		h := newTestServiceHandler(conf, trans)
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost/service1/v1", nil)
+		req.Header.Set("Cookie", "session=1")
+		h.ServeHTTP(rw, req)
+
+		Convey("The request to the backend has the identity and not the cookies", func() {
+			So(trans.LastRequest.Header.Get("X-App-Id"), ShouldEqual, "MyApp")
+			So(trans.LastRequest.Header.Get("X-Plan"), ShouldEqual, "Gold")
+			So(trans.LastRequest.Header["X-Missing"], ShouldBeNil)
+			So(trans.LastRequest.Header.Get("Cookie"), ShouldEqual, "")
+			So(req.Header.Get("Cookie"), ShouldEqual, "session=1")
+		})
+
+		Convey("The response is cleaned up", func() {
+			h := newTestServiceHandler(conf, &FactoryTransport{Response: res})
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			So(rw.Header().Get("X-Internal-Host"), ShouldEqual, "")
+			So(rw.Header().Get("X-Old"), ShouldEqual, "")
+			So(rw.Header().Get("X-New"), ShouldEqual, "value")
+			So(rw.Header().Get("X-Served-By"), ShouldEqual, "service1")
+		})
+
+		Convey("The response headers have the case of the rules", func() {
+			h := newTestServiceHandler(conf, &FactoryTransport{Response: res})
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			So(rw.Header()["X-DL-plan"], ShouldResemble, []string{"Gold"})
+			So(rw.Header()["X-DL-Count"], ShouldResemble, []string{"3"})
+			So(rw.Header()["X-Dl-Count"], ShouldBeNil)
+		})
+
+		Convey("The secrets of the broker are not available to the rules", func() {
+			h := newTestServiceHandler(conf, &FactoryTransport{Response: res})
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			So(rw.Header().Get("X-Provider-Key"), ShouldEqual, "")
+		})
+	})
+}
+
+func TestServiceHandlerIdentity(t *testing.T) {
+	key := []byte("secret")
+	conf := &ServiceConf{Path: "/service1/v1", Scopes: map[string][]string{"Gold": {"read", "write"}}}
+
+	Convey("Given a service signing the identity of the apps", t, func() {
+		trans := &RecordTransport{}
+		h := newTestServiceHandler(conf, trans)
+		h.Identity = &identity.HMACSigner{Key: key}
+
+		Convey("When a client tries to spoof it", func() {
+			req, _ := http.NewRequest("GET", "http://localhost/service1/v1", nil)
+			req.Header.Set(identity.AppIdHeader, "SomeoneElse")
+			req.Header.Set("X-Authproxy-Admin", "true")
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			Convey("The backend gets only the identity signed by the proxy", func() {
+				id, err := identity.Verify(trans.LastRequest, key, time.Minute)
+				So(err, ShouldBeNil)
+				So(id.AppId, ShouldEqual, "MyApp")
+				So(id.Scopes, ShouldResemble, []string{"read", "write"})
+				So(trans.LastRequest.Header.Get("X-Authproxy-Admin"), ShouldEqual, "")
+			})
+		})
+
+		Convey("The request rules can't touch the identity headers", func() {
+			for _, rules := range []*HeaderRules{
+				{Rename: map[string]string{"x-authproxy-app-id": "X-Copy"}},
+				{Rename: map[string]string{"X-App": "X-Authproxy-App-Id"}},
+				{Set: map[string]string{"X-Authproxy-Plan": "Gold"}},
+				{Add: map[string]string{"X-Authproxy-Scopes": "admin"}},
+			} {
+				So((&HeadersConf{Request: rules}).compile(), ShouldNotBeNil)
+			}
+			So((&HeadersConf{Response: &HeaderRules{Set: map[string]string{"X-Authproxy-Plan": "Gold"}}}).compile(), ShouldBeNil)
+		})
+	})
+}
+
+// a http.RoundTripper answering with the responses in turn
+type sequenceTransport struct {
+	Responses []*http.Response
+	Requests  []*http.Request
+}
+
+func (t *sequenceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.Requests = append(t.Requests, req)
+	res := t.Responses[0]
+	if len(t.Responses) > 1 {
+		t.Responses = t.Responses[1:]
+	}
+	return res, nil
+}
+
+func redirect(status int, location string) *http.Response {
+	res := NewResponse(status, "")
+	res.Header.Set("Location", location)
+	return res
+}
+
+func TestServiceHandlerRedirects(t *testing.T) {
+	Convey("Given a backend answering with a redirect", t, func() {
+		send := func(conf *ServiceConf, trans http.RoundTripper, method string) *httptest.ResponseRecorder {
+			h := newTestServiceHandler(conf, trans)
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, "http://api.example.org/service1/v1", nil)
+			h.ServeHTTP(rw, req)
+			return rw
+		}
+
+		Convey("A 304 is never an error", func() {
+			rw := send(&ServiceConf{Path: "/service1/v1"}, &FactoryTransport{Response: NewResponse(304, "")}, "GET")
+			So(rw.Code, ShouldEqual, 304)
+		})
+
+		Convey("When redirects are rejected he gets a 502", func() {
+			rw := send(&ServiceConf{Path: "/service1/v1"}, &FactoryTransport{Response: redirect(302, "/other")}, "GET")
+			So(rw.Code, ShouldEqual, 502)
+		})
+
+		Convey("When redirects are passed the Location points to the proxy", func() {
+			conf := &ServiceConf{Path: "/service1/v1", Redirects: &RedirectConf{Policy: "pass"}}
+			rw := send(conf, &FactoryTransport{Response: redirect(303, "http://example.com/service1/items/1")}, "POST")
+			So(rw.Code, ShouldEqual, 303)
+			So(rw.Header().Get("Location"), ShouldEqual, "http://api.example.org/service1/v1/items/1")
+
+			rw = send(conf, &FactoryTransport{Response: redirect(302, "https://elsewhere.com/x")}, "GET")
+			So(rw.Header().Get("Location"), ShouldEqual, "https://elsewhere.com/x")
+		})
+
+		Convey("When redirects are passed the Location on any backend points to the proxy", func() {
+			conf := &ServiceConf{Path: "/service1/v1", Redirects: &RedirectConf{Policy: "pass"}}
+			first, _ := url.Parse("http://example.com/service1")
+			second, _ := url.Parse("http://example.net/service1")
+			lb := NewLoadBalancer(&StaticDiscoverer{Services: []Service{Service(*first), Service(*second)}}, &RandomRouter{}, time.Second)
+			lb.Start()
+			h := NewServiceHandler("service1", conf, &FactoryTransport{Response: redirect(302, "http://example.net/service1/items/1")}, &goldBroker{}, lb)
+
+			for i := 0; i < 4; i++ {
+				rw := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", "http://api.example.org/service1/v1", nil)
+				h.ServeHTTP(rw, req)
+				So(rw.Header().Get("Location"), ShouldEqual, "http://api.example.org/service1/v1/items/1")
+			}
+		})
+
+		Convey("When redirects are followed he gets the final response", func() {
+			conf := &ServiceConf{Path: "/service1/v1", Redirects: &RedirectConf{Policy: "follow", MaxHops: 2}}
+			trans := &sequenceTransport{Responses: []*http.Response{redirect(303, "/service1/items/1"), NewResponse(200, "item")}}
+			rw := send(conf, trans, "POST")
+			So(rw.Code, ShouldEqual, 200)
+			So(rw.Body.String(), ShouldEqual, "item")
+			So(trans.Requests[1].Method, ShouldEqual, "GET")
+			So(trans.Requests[1].URL.String(), ShouldEqual, "http://example.com/service1/items/1")
+
+			trans = &sequenceTransport{Responses: []*http.Response{redirect(302, "/service1/loop")}}
+			rw = send(conf, trans, "GET")
+			So(rw.Code, ShouldEqual, 502)
+			So(trans.Requests, ShouldHaveLength, 3)
+
+			trans = &sequenceTransport{Responses: []*http.Response{redirect(302, "http://evil.com/")}}
+			rw = send(conf, trans, "GET")
+			So(rw.Code, ShouldEqual, 502)
+			So(trans.Requests, ShouldHaveLength, 1)
+		})
+	})
+}
+
+func TestServiceHandlerCORS(t *testing.T) {
+	conf := &ServiceConf{
+		Path: "/service1/v1",
+		CORS: &CORSConf{
+			AllowedOrigins: []string{"https://*.example.org"},
+			AllowedHeaders: []string{"Content-Type"},
+			ExposedHeaders: []string{"X-DL-units"},
+			MaxAge:         600,
+		},
+	}
+
+	Convey("Given a service allowing cross-origin requests", t, func() {
+		trans := &RecordTransport{}
+		h := newTestServiceHandler(conf, trans)
+
+		Convey("When a browser sends a preflight request", func() {
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest("OPTIONS", "http://localhost/service1/v1", nil)
+			req.Header.Set("Origin", "https://app.example.org")
+			req.Header.Set("Access-Control-Request-Method", "POST")
+			req.Header.Set("Access-Control-Request-Headers", "content-type")
+			h.ServeHTTP(rw, req)
+
+			Convey("The proxy answers it without calling the backend", func() {
+				So(rw.Code, ShouldEqual, 204)
+				So(rw.Header().Get("Access-Control-Allow-Origin"), ShouldEqual, "https://app.example.org")
+				So(rw.Header().Get("Access-Control-Allow-Methods"), ShouldEqual, "POST")
+				So(rw.Header().Get("Access-Control-Max-Age"), ShouldEqual, "600")
+				So(trans.LastRequest, ShouldBeNil)
+			})
+		})
+
+		Convey("When the origin is not allowed", func() {
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest("OPTIONS", "http://localhost/service1/v1", nil)
+			req.Header.Set("Origin", "https://evil.com")
+			req.Header.Set("Access-Control-Request-Method", "GET")
+			h.ServeHTTP(rw, req)
+
+			So(rw.Code, ShouldEqual, 403)
+			So(rw.Header().Get("Access-Control-Allow-Origin"), ShouldEqual, "")
+		})
+
+		Convey("When the backend allows an origin that the proxy doesn't", func() {
+			res := NewResponse(200, "")
+			res.Header.Set("Access-Control-Allow-Origin", "*")
+			res.Header.Set("Access-Control-Allow-Credentials", "true")
+			h := newTestServiceHandler(conf, &FactoryTransport{Response: res})
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "http://localhost/service1/v1", nil)
+			req.Header.Set("Origin", "https://evil.com")
+			h.ServeHTTP(rw, req)
+
+			Convey("The policy of the proxy wins", func() {
+				So(rw.Header().Get("Access-Control-Allow-Origin"), ShouldEqual, "")
+				So(rw.Header().Get("Access-Control-Allow-Credentials"), ShouldEqual, "")
+			})
+		})
+
+		Convey("Credentials can't be allowed for any origin", func() {
+			So((&CORSConf{AllowedOrigins: []string{"*"}, AllowCredentials: true}).validate(), ShouldNotBeNil)
+			So((&CORSConf{AllowedOrigins: []string{"*"}}).validate(), ShouldBeNil)
+		})
+
+		Convey("When a browser sends a request", func() {
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "http://localhost/service1/v1", nil)
+			req.Header.Set("Origin", "https://app.example.org")
+			h.ServeHTTP(rw, req)
+
+			Convey("The response can be read by the browser", func() {
+				So(rw.Header().Get("Access-Control-Allow-Origin"), ShouldEqual, "https://app.example.org")
+				So(rw.Header().Get("Access-Control-Expose-Headers"), ShouldEqual, "X-DL-units")
+				So(rw.Header()["Vary"], ShouldResemble, []string{"Origin"})
+			})
+		})
+	})
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	RegisterEncoder("test", func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) })
+
+	cases := []struct {
+		encodings      []string
+		acceptEncoding string
+		expected       string
+	}{
+		{nil, "gzip, deflate", "gzip"},
+		{nil, "br", ""},
+		{nil, "gzip;q=0", ""},
+		{nil, "*", "gzip"},
+		{[]string{"zstd", "gzip"}, "zstd, gzip", "gzip"},
+		{[]string{"test", "gzip"}, "gzip, test", "test"},
+		{[]string{"test", "gzip"}, "gzip, test;q=0", "gzip"},
+		{nil, "", ""},
+	}
+	for i, c := range cases {
+		conf := &CompressionConf{Encodings: c.encodings}
+		if coding := conf.negotiate(c.acceptEncoding); coding != c.expected {
+			t.Errorf("Case %d: expected %q, got %q", i, c.expected, coding)
+		}
+	}
+}
+
+func TestServiceHandlerCompression(t *testing.T) {
+	conf := &ServiceConf{
+		Path:        "/service1/v1",
+		Compression: &CompressionConf{MinSize: 16, DecompressRequests: true},
+	}
+	payload := `{"text": "` + strings.Repeat("hello ", 20) + `"}`
+
+	Convey("Given a service compressing the responses", t, func() {
+		res := NewResponse(200, payload)
+		res.ContentLength = int64(len(payload))
+		res.Header.Set("Content-Type", "application/json; charset=utf-8")
+		res.Header.Set("Etag", `"v1"`)
+		h := newTestServiceHandler(conf, &FactoryTransport{Response: res})
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost/service1/v1", nil)
+
+		Convey("When the client accepts gzip", func() {
+			req.Header.Set("Accept-Encoding", "br;q=0, gzip")
+			h.ServeHTTP(rw, req)
+
+			Convey("The response is compressed", func() {
+				So(rw.Header().Get("Content-Encoding"), ShouldEqual, "gzip")
+				So(rw.Header().Get("Vary"), ShouldEqual, "Accept-Encoding")
+				So(rw.Header().Get("Etag"), ShouldEqual, `W/"v1"`)
+				body, err := gzip.NewReader(rw.Body)
+				So(err, ShouldBeNil)
+				content, _ := ioutil.ReadAll(body)
+				So(string(content), ShouldEqual, payload)
+			})
+		})
+
+		Convey("When the client doesn't accept it", func() {
+			h.ServeHTTP(rw, req)
+
+			So(rw.Header().Get("Content-Encoding"), ShouldEqual, "")
+			So(rw.Body.String(), ShouldEqual, payload)
+		})
+
+		Convey("When the response is too small", func() {
+			res.Body = ioutil.NopCloser(strings.NewReader("{}"))
+			res.ContentLength = 2
+			req.Header.Set("Accept-Encoding", "gzip")
+			h.ServeHTTP(rw, req)
+
+			So(rw.Header().Get("Content-Encoding"), ShouldEqual, "")
+			So(rw.Body.String(), ShouldEqual, "{}")
+		})
+
+		Convey("When the backend compressed the response", func() {
+			res.Header.Set("Content-Encoding", "br")
+			req.Header.Set("Accept-Encoding", "gzip")
+			h.ServeHTTP(rw, req)
+
+			So(rw.Header().Get("Content-Encoding"), ShouldEqual, "br")
+			So(rw.Body.String(), ShouldEqual, payload)
+		})
+
+		Convey("When the response is partial", func() {
+			res.StatusCode = http.StatusPartialContent
+			res.Header.Set("Content-Range", "bytes 0-131/1000")
+			req.Header.Set("Accept-Encoding", "gzip")
+			h.ServeHTTP(rw, req)
+
+			So(rw.Code, ShouldEqual, http.StatusPartialContent)
+			So(rw.Header().Get("Content-Encoding"), ShouldEqual, "")
+			So(rw.Header().Get("Content-Range"), ShouldEqual, "bytes 0-131/1000")
+			So(rw.Body.String(), ShouldEqual, payload)
+		})
+	})
+
+	Convey("Given a gzip request body", t, func() {
+		trans := &RecordTransport{}
+		h := newTestServiceHandler(conf, trans)
+		var buffer bytes.Buffer
+		gz := gzip.NewWriter(&buffer)
+		gz.Write([]byte("$app_id=MyApp&text=hello"))
+		gz.Close()
+		req, _ := http.NewRequest("POST", "http://localhost/service1/v1", &buffer)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Content-Encoding", "gzip")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		Convey("The body is inflated before it's parsed and sent to the backend", func() {
+			So(trans.LastRequest.Header.Get("Content-Encoding"), ShouldEqual, "")
+			So(trans.LastRequest.ContentLength, ShouldEqual, 24)
+			content, _ := ioutil.ReadAll(trans.LastRequest.Body)
+			So(string(content), ShouldEqual, "$app_id=MyApp&text=hello")
+		})
+	})
+}
+
+// a gold broker recording the credits of the reported responses
+type reportingBroker struct {
+	goldBroker
+	mu      sync.Mutex
+	Credits []string
+}
+
+func (b *reportingBroker) Report(res *http.Response, msg authbroker.BrokerMessage) (chan bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.Credits = append(b.Credits, res.Header.Get(authbroker.CreditsHeader))
+	return nil, nil
+}
+
+func cacheable(body, cacheControl string) *http.Response {
+	res := NewResponse(200, body)
+	res.ContentLength = int64(len(body))
+	res.Header.Set("Cache-Control", cacheControl)
+	res.Header.Set("Etag", `"`+body+`"`)
+	res.Header.Set("X-DL-units", "2")
+	return res
+}
+
+func TestServiceHandlerCache(t *testing.T) {
+	get := func(h http.Handler, path string, header map[string]string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		h.ServeHTTP(rw, req)
+		return rw
+	}
+
+	Convey("Given a service caching the responses", t, func() {
+		hitCredits := 0.5
+		conf := &ServiceConf{
+			Path:  "/service1/v1",
+			Query: &QueryConf{Strip: []string{"callback"}},
+			Cache: &CacheConf{},
+		}
+		trans := &sequenceTransport{}
+		h := newTestServiceHandler(conf, trans)
+
+		Convey("Fresh responses are served from the cache", func() {
+			trans.Responses = []*http.Response{cacheable("first", "max-age=60"), cacheable("second", "max-age=60")}
+			get(h, "/service1/v1?q=1", nil)
+			rw := get(h, "/service1/v1?q=1&callback=x", nil)
+
+			So(len(trans.Requests), ShouldEqual, 1)
+			So(rw.Body.String(), ShouldEqual, "first")
+			So(rw.Header().Get("X-Cache"), ShouldEqual, "HIT")
+			So(rw.Header()["X-DL-units"], ShouldResemble, []string{"0"})
+
+			Convey("Unless it's another document", func() {
+				rw := get(h, "/service1/v1?q=2", nil)
+				So(rw.Body.String(), ShouldEqual, "second")
+				So(rw.Header().Get("X-Cache"), ShouldEqual, "MISS")
+			})
+
+			Convey("Or the client wants it fresh", func() {
+				rw := get(h, "/service1/v1?q=1", map[string]string{"Cache-Control": "no-cache"})
+				So(rw.Body.String(), ShouldEqual, "second")
+			})
+
+			Convey("Clients having the document get a 304", func() {
+				rw := get(h, "/service1/v1?q=1", map[string]string{"If-None-Match": `W/"first"`})
+				So(rw.Code, ShouldEqual, 304)
+				So(rw.Body.Len(), ShouldEqual, 0)
+			})
+		})
+
+		Convey("Hits can be reported", func() {
+			broker := &reportingBroker{}
+			conf.Cache = &CacheConf{ReportHits: true, HitCredits: &hitCredits}
+			h := NewServiceHandler("service1", conf, trans, broker, h.Balancer)
+			trans.Responses = []*http.Response{cacheable("first", "max-age=60")}
+			get(h, "/service1/v1", nil)
+			get(h, "/service1/v1", nil)
+
+			So(broker.Credits, ShouldResemble, []string{"2", "0.5"})
+		})
+
+		Convey("Private responses are not stored", func() {
+			trans.Responses = []*http.Response{cacheable("first", "private, max-age=60"), cacheable("second", "max-age=60")}
+			get(h, "/service1/v1", nil)
+			rw := get(h, "/service1/v1", nil)
+			So(rw.Body.String(), ShouldEqual, "second")
+		})
+
+		Convey("Stale responses are revalidated", func() {
+			trans.Responses = []*http.Response{cacheable("first", "no-cache"), NewResponse(304, "")}
+			get(h, "/service1/v1", nil)
+			rw := get(h, "/service1/v1", nil)
+
+			So(trans.Requests[1].Header.Get("If-None-Match"), ShouldEqual, `"first"`)
+			So(rw.Code, ShouldEqual, 200)
+			So(rw.Body.String(), ShouldEqual, "first")
+			So(rw.Header().Get("X-Cache"), ShouldEqual, "REVALIDATED")
+		})
+
+		Convey("Responses varying by a header are stored by its value", func() {
+			first, second := cacheable("first", "max-age=60"), cacheable("second", "max-age=60")
+			first.Header.Set("Vary", "Accept-Language")
+			second.Header.Set("Vary", "Accept-Language")
+			trans.Responses = []*http.Response{first, second}
+			get(h, "/service1/v1", map[string]string{"Accept-Language": "en"})
+
+			So(get(h, "/service1/v1", map[string]string{"Accept-Language": "it"}).Body.String(), ShouldEqual, "second")
+			So(get(h, "/service1/v1", map[string]string{"Accept-Language": "en"}).Body.String(), ShouldEqual, "first")
+			So(len(trans.Requests), ShouldEqual, 2)
+		})
+	})
+}
+
+func TestCacheStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	disk, err := NewDiskCache(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(dir, "other")
+	ioutil.WriteFile(other, []byte("not an entry"), 0644)
+
+	for name, store := range map[string]CacheStore{"memory": NewMemoryCache(2, 0), "disk": disk} {
+		store.Set(&CacheEntry{Key: "a", Status: 200, Body: []byte("A")})
+		if e := store.Get("a"); e == nil || string(e.Body) != "A" {
+			t.Errorf("%s: the entry is not stored: %v", name, e)
+		}
+		store.Delete("a")
+		if e := store.Get("a"); e != nil {
+			t.Errorf("%s: the entry is not deleted", name)
+		}
+	}
+
+	lru := NewMemoryCache(2, 0)
+	for _, key := range []string{"a", "b", "a", "c"} {
+		if lru.Get(key) == nil {
+			lru.Set(&CacheEntry{Key: key})
+		}
+	}
+	if lru.Get("b") != nil || lru.Get("a") == nil || lru.Get("c") == nil {
+		t.Error("The least recently used entry should be evicted")
+	}
+
+	small, _ := NewDiskCache(dir, 1)
+	small.Set(&CacheEntry{Key: "a", Body: []byte("A")})
+	if _, err := os.Stat(other); err != nil {
+		t.Error("The disk cache should remove only its own files:", err)
+	}
+}
+
+// a http.RoundTripper answering when it's told to
+type blockingTransport struct {
+	mu       sync.Mutex
+	calls    int
+	started  chan bool
+	response chan bool
+}
+
+func (t *blockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.calls++
+	t.mu.Unlock()
+	t.started <- true
+	<-t.response
+	return NewResponse(200, "shared"), nil
+}
+
+func TestServiceHandlerCoalesce(t *testing.T) {
+	Convey("Given a service coalescing the requests", t, func() {
+		trans := &blockingTransport{started: make(chan bool, 10), response: make(chan bool)}
+		broker := &reportingBroker{}
+		conf := &ServiceConf{Path: "/service1/v1", Coalesce: &CoalesceConf{}}
+		h := newTestServiceHandler(conf, trans)
+		h.Broker = broker
+
+		serve := func(path string, results chan string) {
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+			h.ServeHTTP(rw, req)
+			results <- rw.Body.String()
+		}
+
+		Convey("Identical requests in flight share the backend request", func() {
+			results := make(chan string, 3)
+			go serve("/service1/v1?q=1", results)
+			<-trans.started
+			go serve("/service1/v1?q=1", results)
+			go serve("/service1/v1?q=1", results)
+			// the others join the request in flight
+			time.Sleep(100 * time.Millisecond)
+			close(trans.response)
+
+			for i := 0; i < 3; i++ {
+				So(<-results, ShouldEqual, "shared")
+			}
+			So(trans.calls, ShouldEqual, 1)
+			So(len(broker.Credits), ShouldEqual, 3)
+		})
+
+		Convey("Different requests don't", func() {
+			results := make(chan string, 2)
+			go serve("/service1/v1?q=1", results)
+			go serve("/service1/v1?q=2", results)
+			<-trans.started
+			<-trans.started
+			close(trans.response)
+
+			So(<-results, ShouldEqual, "shared")
+			So(<-results, ShouldEqual, "shared")
+			So(trans.calls, ShouldEqual, 2)
+		})
+
+		Convey("The request header templates can't be coalesced", func() {
+			So(conf.Coalesce.validate(&HeadersConf{Request: &HeaderRules{Set: map[string]string{"X-App": "{{.appId}}"}}}), ShouldNotBeNil)
+			So(conf.Coalesce.validate(&HeadersConf{Request: &HeaderRules{Add: map[string]string{"X-Request": "{{.requestId}}"}}}), ShouldNotBeNil)
+			So(conf.Coalesce.validate(&HeadersConf{Request: &HeaderRules{Set: map[string]string{"X-Version": "2"}}}), ShouldBeNil)
+		})
+	})
+}
+
+// a http.RoundTripper answering for the real and for the shadow backends
+type shadowTransport struct {
+	shadowRequests chan *http.Request
+}
+
+func (t *shadowTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == "shadow.example.com" {
+		t.shadowRequests <- req
+		return NewResponse(500, "broken"), nil
+	}
+	return NewResponse(200, "primary"), nil
+}
+
+func TestServiceHandlerMirror(t *testing.T) {
+	Convey("Given a service mirroring all its requests", t, func() {
+		trans := &shadowTransport{shadowRequests: make(chan *http.Request, 1)}
+		conf := &ServiceConf{Path: "/service1/v1", Mirror: &MirrorConf{Percentage: 100}}
+		h := newTestServiceHandler(conf, trans)
+		h.Name = "mirrored"
+		backend, _ := url.Parse("http://shadow.example.com/service1")
+		h.Shadow = NewLoadBalancer(&StaticDiscoverer{Services: []Service{Service(*backend)}}, &RandomRouter{}, time.Second)
+		h.Shadow.Start()
+
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "http://localhost/service1/v1", strings.NewReader("text=hello"))
+		h.ServeHTTP(rw, req)
+
+		Convey("The client gets the response of the real backend", func() {
+			So(rw.Code, ShouldEqual, 200)
+			So(rw.Body.String(), ShouldEqual, "primary")
+		})
+
+		Convey("The shadow backend gets a copy of the request", func() {
+			shadowReq := <-trans.shadowRequests
+			So(shadowReq.Header.Get("X-Authproxy-Mirror"), ShouldEqual, "1")
+			content, _ := ioutil.ReadAll(shadowReq.Body)
+			So(string(content), ShouldEqual, "text=hello")
+
+			Convey("And the difference is recorded", func() {
+				expected := `authproxy_mirror_requests_total{service="mirrored",result="status_diff"}`
+				recorded := false
+				for i := 0; i < 100 && !recorded; i++ {
+					var buf bytes.Buffer
+					metrics.DefaultRegistry.Expose(&buf)
+					recorded = strings.Contains(buf.String(), expected)
+					time.Sleep(10 * time.Millisecond)
+				}
+				So(recorded, ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestServiceHandlerAdaptiveConcurrency(t *testing.T) {
+	Convey("Given a service with an adaptive concurrency limit", t, func() {
+		conf := &ServiceConf{
+			Path:        "/service1/v1",
+			Concurrency: &ConcurrencyConf{MaxInFlight: 8, Adaptive: &AdaptiveConf{MinLimit: 1, MaxLimit: 8, BackoffRatio: 0.5}},
+		}
+		send := func(trans http.RoundTripper) *ServiceHandler {
+			h := newTestServiceHandler(conf, trans)
+			req, _ := http.NewRequest("GET", "http://localhost/service1/v1", http.NoBody)
+			h.ServeHTTP(httptest.NewRecorder(), req)
+			return h
+		}
+
+		Convey("Every failed attempt decreases the limit", func() {
+			trans := &failingTransport{}
+			h := send(trans)
+
+			So(len(trans.Bodies), ShouldEqual, 3)
+			So(h.concurrency.Limit(), ShouldEqual, 1)
+		})
+
+		Convey("The gateway errors of the backends decrease the limit", func() {
+			h := send(&FactoryTransport{Response: NewResponse(503, "")})
+
+			So(h.concurrency.Limit(), ShouldEqual, 4)
+		})
+	})
+}
@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gigaroby/authproxy/authbroker"
+	"github.com/gigaroby/authproxy/identity"
+	"github.com/gigaroby/authproxy/requestid"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// HeadersConf changes the headers of the requests sent to the backends
+// and of the responses sent to the clients.
+type HeadersConf struct {
+	Request  *HeaderRules `json:"request"`
+	Response *HeaderRules `json:"response"`
+}
+
+// HeaderRules are applied in the order of the fields. The values of Set and Add
+// are templates, executed with the appId, plan, provider and scopes of the app,
+// the service and the requestId, e.g. "{{.appId}}" or "{{.plan}}".
+// Headers whose value is empty are not set. The headers are matched in any case,
+// and written in the case of the rules, which some clients depend on.
+// The request rules can't change the X-Authproxy-* headers, only the proxy sends them.
+type HeaderRules struct {
+	Rename map[string]string `json:"rename"`
+	Remove []string          `json:"remove"`
+	Set    map[string]string `json:"set"`
+	Add    map[string]string `json:"add"`
+
+	set map[string]*template.Template
+	add map[string]*template.Template
+}
+
+func compileTemplates(values map[string]string) (map[string]*template.Template, error) {
+	templates := make(map[string]*template.Template)
+	for k, v := range values {
+		t, err := template.New(k).Option("missingkey=zero").Parse(v)
+		if err != nil {
+			return nil, err
+		}
+		templates[k] = t
+	}
+	return templates, nil
+}
+
+// identityHeaders lists the headers of the rules that only the proxy can send.
+func (r *HeaderRules) identityHeaders() (names []string) {
+	var all []string
+	for from, to := range r.Rename {
+		all = append(all, from, to)
+	}
+	for k := range r.Set {
+		all = append(all, k)
+	}
+	for k := range r.Add {
+		all = append(all, k)
+	}
+	for _, name := range all {
+		if strings.HasPrefix(http.CanonicalHeaderKey(name), identity.HeaderPrefix) {
+			names = append(names, name)
+		}
+	}
+	return
+}
+
+func (c *HeadersConf) compile() (err error) {
+	if c == nil {
+		return
+	}
+	if c.Request != nil {
+		if names := c.Request.identityHeaders(); len(names) > 0 {
+			return fmt.Errorf("the request rules can't change the identity headers %v", names)
+		}
+	}
+	for _, rules := range []*HeaderRules{c.Request, c.Response} {
+		if rules == nil {
+			continue
+		}
+		if rules.set, err = compileTemplates(rules.Set); err != nil {
+			return
+		}
+		if rules.add, err = compileTemplates(rules.Add); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func render(t *template.Template, data map[string]string) string {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		logger.Infom("Can't render the header "+t.Name(), map[string]interface{}{
+			"request_id": data["requestId"],
+			"error":      err.Error(),
+		})
+		return ""
+	}
+	return buf.String()
+}
+
+// the case some clients expect, whatever the backends send
+var defaultResponseRules = &HeaderRules{
+	Rename: map[string]string{
+		"X-DL-Count":           "X-DL-Count",
+		"X-DL-datagem-version": "X-DL-datagem-version",
+	},
+}
+
+// delHeader removes name from header in any case, returning its values.
+func delHeader(header http.Header, name string) (vv []string) {
+	for k, values := range header {
+		if strings.EqualFold(k, name) {
+			vv = append(vv, values...)
+			delete(header, k)
+		}
+	}
+	return
+}
+
+func (r *HeaderRules) apply(header http.Header, data map[string]string) {
+	if r == nil {
+		return
+	}
+	// don't use Set and Add, they change the case of the keys
+	for from, to := range r.Rename {
+		if vv := delHeader(header, from); len(vv) > 0 {
+			delHeader(header, to)
+			header[to] = vv
+		}
+	}
+	for _, k := range r.Remove {
+		delHeader(header, k)
+	}
+	for k, t := range r.set {
+		if v := render(t, data); v != "" {
+			delHeader(header, k)
+			header[k] = []string{v}
+		}
+	}
+	for k, t := range r.add {
+		if v := render(t, data); v != "" {
+			header[k] = append(delHeader(header, k), v)
+		}
+	}
+}
+
+// requestHeaders removes the identity headers sent by the client, applies the request
+// rules of the service to a request for the backend, then signs the identity of the app, if any.
+func (h *ServiceHandler) requestHeaders(outReq *http.Request, msg authbroker.BrokerMessage) {
+	// the headers may still be shared with the incoming request
+	outReq.Header = cloneHeader(outReq.Header)
+
+	// before the rules, which could copy them elsewhere
+	identity.Strip(outReq.Header)
+	if h.Conf.Headers != nil && h.Conf.Headers.Request != nil {
+		h.Conf.Headers.Request.apply(outReq.Header, h.templateData(outReq, msg))
+	}
+
+	if h.Identity != nil && msg["appId"] != "" {
+		h.Identity.Sign(h.identity(msg), outReq)
+	}
+}
+
+// identity describes the app authenticated by the broker.
+func (h *ServiceHandler) identity(msg authbroker.BrokerMessage) *identity.Identity {
+	id := &identity.Identity{AppId: msg["appId"], Plan: msg["plan"], Provider: msg["provider"]}
+	if scopes := msg["scopes"]; scopes != "" {
+		id.Scopes = strings.Split(scopes, ",")
+	} else {
+		id.Scopes = h.Conf.Scopes[id.Plan]
+	}
+	return id
+}
+
+// responseHeaders applies the default response rules, then the ones of the service,
+// to the headers for the client.
+func (h *ServiceHandler) responseHeaders(header http.Header, req *http.Request, msg authbroker.BrokerMessage) {
+	defaultResponseRules.apply(header, nil)
+	if h.Conf.Headers == nil || h.Conf.Headers.Response == nil {
+		return
+	}
+	h.Conf.Headers.Response.apply(header, h.templateData(req, msg))
+}
+
+// the values of the broker message the header templates can use,
+// the others (e.g. the provider key) must not reach the clients nor the backends
+var templateKeys = []string{"appId", "plan", "provider", "scopes"}
+
+// templateData is what the header templates can use.
+func (h *ServiceHandler) templateData(req *http.Request, msg authbroker.BrokerMessage) map[string]string {
+	data := map[string]string{
+		"service":   h.Name,
+		"requestId": requestid.FromContext(req.Context()),
+	}
+	for _, k := range templateKeys {
+		data[k] = msg[k]
+	}
+	return data
+}
@@ -6,6 +6,8 @@ import (
 )
 
 type LoadBalancer struct {
+	// Name of the service, used in metrics.
+	Name string
 	// Discoverer is responsable for returning the
 	// list of all the backend services.
 	Discoverer ServiceDiscoverer
@@ -16,10 +18,36 @@ type LoadBalancer struct {
 	// Services should be requested on this channel
 	Services chan Service
 
+	// Backends failing EjectAfter times in a row are not used for EjectFor.
+	EjectAfter int
+	EjectFor   time.Duration
+
 	mu             sync.Mutex
 	cachedServices []Service
+	states         map[string]*backendState
 	started        bool
 	quit           chan chan bool
+	refresh        chan bool
+}
+
+type backendState struct {
+	inFlight     int
+	failures     int
+	ejectedUntil time.Time
+	draining     bool
+}
+
+// BackendStatus describes the state of a backend of a service.
+type BackendStatus struct {
+	URL      string `json:"url"`
+	InFlight int    `json:"inFlight"`
+	// consecutive failures
+	Failures     int        `json:"failures"`
+	Ejected      bool       `json:"ejected"`
+	EjectedUntil *time.Time `json:"ejectedUntil,omitempty"`
+	Draining     bool       `json:"draining"`
+	// a draining backend with no requests in flight can be removed
+	Drained bool `json:"drained"`
 }
 
 func NewLoadBalancer(d ServiceDiscoverer, r RequestRouter, fi time.Duration) *LoadBalancer {
@@ -27,10 +55,14 @@ func NewLoadBalancer(d ServiceDiscoverer, r RequestRouter, fi time.Duration) *Lo
 		Discoverer:    d,
 		Router:        r,
 		FetchInterval: fi,
+		EjectAfter:    3,
+		EjectFor:      10 * time.Second,
 
 		Services: make(chan Service),
+		states:   make(map[string]*backendState),
 		started:  false,
 		quit:     make(chan chan bool),
+		refresh:  make(chan bool),
 	}
 
 	return ldb
@@ -68,9 +100,129 @@ func (l *LoadBalancer) fetchUnsafe() error {
 		return err
 	}
 	l.cachedServices = newServices
+	poolSize.Set(float64(len(newServices)), l.Name)
+
+	// forget the state of the backends that are gone
+	current := make(map[string]bool)
+	for _, s := range newServices {
+		current[s.String()] = true
+	}
+	for key, state := range l.states {
+		if !current[key] && state.inFlight == 0 {
+			delete(l.states, key)
+		}
+	}
 	return nil
 }
 
+// Refresh fetches the list of services right away.
+func (l *LoadBalancer) Refresh() {
+	l.fetch()
+	l.wake()
+}
+
+// wake makes the loop choose again the next service, which it may have
+// chosen before the backends changed.
+func (l *LoadBalancer) wake() {
+	select {
+	case l.refresh <- true:
+	default:
+	}
+}
+
+func (l *LoadBalancer) stateUnsafe(s Service) *backendState {
+	key := s.String()
+	state, ok := l.states[key]
+	if !ok {
+		state = &backendState{}
+		l.states[key] = state
+	}
+	return state
+}
+
+// Drain stops sending new requests to s. The requests in flight are not affected.
+func (l *LoadBalancer) Drain(s Service) {
+	l.mu.Lock()
+	l.stateUnsafe(s).draining = true
+	l.mu.Unlock()
+	l.wake()
+}
+
+// Undrain sends new requests to s again.
+func (l *LoadBalancer) Undrain(s Service) {
+	l.mu.Lock()
+	l.stateUnsafe(s).draining = false
+	l.mu.Unlock()
+	l.wake()
+}
+
+// Acquire records that a request is being sent to s.
+func (l *LoadBalancer) Acquire(s Service) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stateUnsafe(s).inFlight++
+}
+
+// Release records that a request sent to s completed.
+func (l *LoadBalancer) Release(s Service) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stateUnsafe(s).inFlight--
+}
+
+// ReportResult records the outcome of a request to s,
+// ejecting it after too many failures.
+func (l *LoadBalancer) ReportResult(s Service, failed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	state := l.stateUnsafe(s)
+	if !failed {
+		state.failures = 0
+		return
+	}
+
+	state.failures++
+	if l.EjectAfter > 0 && state.failures >= l.EjectAfter {
+		logger.Infof("Ejecting backend %s of %s after %d failures", s.String(), l.Name, state.failures)
+		state.ejectedUntil = time.Now().Add(l.EjectFor)
+		state.failures = 0
+	}
+}
+
+// Known returns all the backends, including the draining and the ejected ones.
+func (l *LoadBalancer) Known() []Service {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Service(nil), l.cachedServices...)
+}
+
+// Backends returns the state of all the backends.
+func (l *LoadBalancer) Backends() []BackendStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	statuses := make([]BackendStatus, 0, len(l.cachedServices))
+	for _, s := range l.cachedServices {
+		state := l.stateUnsafe(s)
+		status := BackendStatus{
+			URL:      s.String(),
+			InFlight: state.inFlight,
+			Failures: state.failures,
+			Draining: state.draining,
+			Drained:  state.draining && state.inFlight == 0,
+		}
+		if now.Before(state.ejectedUntil) {
+			until := state.ejectedUntil
+			status.Ejected = true
+			status.EjectedUntil = &until
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
 func (l *LoadBalancer) fetch() {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -82,10 +234,37 @@ func (l *LoadBalancer) fetch() {
 	}
 }
 
+// nextService routes among the backends that are not draining nor ejected.
+// If all the healthy ones are ejected, ejections are ignored.
 func (l *LoadBalancer) nextService() Service {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	return l.Router.Route(l.cachedServices)
+
+	now := time.Now()
+	var available, notDraining []Service
+	for _, s := range l.cachedServices {
+		state, ok := l.states[s.String()]
+		if !ok {
+			available = append(available, s)
+			notDraining = append(notDraining, s)
+			continue
+		}
+		if state.draining {
+			continue
+		}
+		notDraining = append(notDraining, s)
+		if !now.Before(state.ejectedUntil) {
+			available = append(available, s)
+		}
+	}
+
+	if len(available) == 0 {
+		available = notDraining
+	}
+	if len(available) == 0 {
+		return Service{}
+	}
+	return l.Router.Route(available)
 }
 
 func (l *LoadBalancer) loop() {
@@ -95,6 +274,8 @@ func (l *LoadBalancer) loop() {
 		select {
 		case <-tick.C:
 			l.fetch()
+		case <-l.refresh:
+			break
 		case l.Services <- l.nextService():
 			break
 		case quitchan := <-l.quit:
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"github.com/gigaroby/authproxy/metrics"
+	"strconv"
+	"time"
+)
+
+var (
+	requestsTotal = metrics.NewCounterVec("authproxy_requests_total",
+		"Requests handled, by service, backend and status class.", "service", "backend", "status_class")
+	requestDuration = metrics.NewHistogramVec("authproxy_request_duration_seconds",
+		"Time spent waiting for the backends.", nil, "service", "backend")
+	authorizeDuration = metrics.NewHistogramVec("authproxy_broker_authorize_duration_seconds",
+		"Time spent authenticating the requests.", nil, "service")
+	authorizeFailures = metrics.NewCounterVec("authproxy_broker_authorize_failures_total",
+		"Requests that failed authentication, by error code.", "service", "code")
+	backendRetries = metrics.NewCounterVec("authproxy_backend_retries_total",
+		"Backend requests retried after an error.", "service")
+	poolSize = metrics.NewGaugeVec("authproxy_loadbalancer_backends",
+		"Backends available to the load balancer.", "service")
+	cacheRequests = metrics.NewCounterVec("authproxy_cache_requests_total",
+		"Requests that could be served from the cache, by outcome (hit, miss, revalidated).", "service", "outcome")
+	mirrorRequests = metrics.NewCounterVec("authproxy_mirror_requests_total",
+		"Requests mirrored to the shadow backends, by result (match, status_diff, size_diff, error).", "service", "result")
+	mirrorDuration = metrics.NewHistogramVec("authproxy_mirror_duration_seconds",
+		"Time spent waiting for the shadow backends.", nil, "service")
+)
+
+// statusClass returns 2xx, 3xx, ... or "error" if there is no valid status.
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "error"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// recordRequest updates the request metrics using the data we log for every request.
+func (h *ServiceHandler) recordRequest(reqData map[string]interface{}) {
+	backend, _ := reqData["backend"].(string)
+	status, _ := reqData["status"].(int)
+	requestsTotal.Inc(h.Name, backend, statusClass(status))
+
+	if duration, ok := reqData["duration"].(time.Duration); ok {
+		requestDuration.Observe(duration.Seconds(), h.Name, backend)
+	}
+	if attempts, ok := reqData["attempts"].(int); ok && attempts > 1 {
+		backendRetries.Add(float64(attempts-1), h.Name)
+	}
+	if outcome, ok := reqData["cache"].(string); ok {
+		cacheRequests.Inc(h.Name, outcome)
+	}
+}
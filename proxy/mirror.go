@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/gigaroby/authproxy/authbroker"
+	"github.com/gigaroby/authproxy/ioextra"
+	"github.com/gigaroby/authproxy/requestid"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const defaultMirrorTimeout = 10 * time.Second
+
+// sent to the shadow backends, which may want to avoid side effects
+const mirrorHeader = "X-Authproxy-Mirror"
+
+// MirrorConf sends a copy of some of the requests of a service to a shadow pool of
+// backends, to compare their responses with the ones of the real backends.
+// The shadow responses never reach the clients nor the broker.
+type MirrorConf struct {
+	// the URLs of the shadow backends; when empty, they are the ones of Pool in the backends file
+	Backends []string `json:"backends"`
+	Pool     string   `json:"pool"`
+	// the percentage of the requests that are mirrored
+	Percentage float64 `json:"percentage"`
+	// how long (in seconds) to wait for the shadow backends (10 by default)
+	Timeout float64 `json:"timeout"`
+}
+
+// discoverer finds the shadow backends.
+func (c *MirrorConf) discoverer(backendsFile string) (ServiceDiscoverer, error) {
+	if c.Percentage < 0 || c.Percentage > 100 {
+		return nil, fmt.Errorf("the percentage must be between 0 and 100")
+	}
+	if len(c.Backends) == 0 {
+		if c.Pool == "" {
+			return nil, fmt.Errorf("the shadow backends or their pool are required")
+		}
+		return &JsonDiscoverer{Path: backendsFile, Name: c.Pool}, nil
+	}
+
+	d := &StaticDiscoverer{}
+	for _, rawurl := range c.Backends {
+		backend, err := parseBackend(rawurl)
+		if err != nil {
+			return nil, err
+		}
+		d.Services = append(d.Services, backend)
+	}
+	return d, nil
+}
+
+func (c *MirrorConf) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return defaultMirrorTimeout
+	}
+	return time.Duration(c.Timeout * float64(time.Second))
+}
+
+// what a backend answered to a mirrored request
+type mirrorResult struct {
+	// false when the real request never reached a backend
+	reached  bool
+	status   int
+	size     int64
+	duration time.Duration
+	err      error
+}
+
+// a request sent to the shadow backends, waiting for the response of the real ones
+type mirror struct {
+	primary chan mirrorResult
+	// bytes of the body of the real response
+	size int64
+}
+
+// count counts the bytes read from the body of the real response.
+func (m *mirror) count(body io.ReadCloser) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(body, m), body}
+}
+
+func (m *mirror) Write(p []byte) (int, error) {
+	atomic.AddInt64(&m.size, int64(len(p)))
+	return len(p), nil
+}
+
+// done hands the outcome of the real request to the shadow one.
+func (m *mirror) done(reqData map[string]interface{}) {
+	result := mirrorResult{size: atomic.LoadInt64(&m.size)}
+	result.status, _ = reqData["status"].(int)
+	result.duration, _ = reqData["duration"].(time.Duration)
+	backend, _ := reqData["backend"].(string)
+	result.reached = backend != ""
+	m.primary <- result
+}
+
+// startMirror sends a copy of req to the shadow backends, if it's sampled,
+// without waiting for the response.
+// Streamed bodies are never mirrored, they can be read only once.
+func (h *ServiceHandler) startMirror(req *http.Request, msg authbroker.BrokerMessage) *mirror {
+	c := h.Conf.Mirror
+	if c == nil || h.Shadow == nil || rand.Float64()*100 >= c.Percentage {
+		return nil
+	}
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		seeker, ok := req.Body.(io.Seeker)
+		if !ok {
+			return nil
+		}
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		seeker.Seek(0, 0)
+		if err != nil {
+			return nil
+		}
+	}
+
+	// the copy is made now, the real request can change later
+	backend := <-h.Shadow.Services
+	outReq := h.requestToProxy(req, backend)
+	h.requestHeaders(outReq, msg)
+	outReq.Header.Set(mirrorHeader, "1")
+	if body != nil {
+		outReq.Body = ioextra.NewBufferizedClosingReader(body)
+		outReq.ContentLength = int64(len(body))
+	}
+	requestId := requestid.FromContext(req.Context())
+
+	m := &mirror{primary: make(chan mirrorResult, 1)}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout())
+		defer cancel()
+		shadow := h.shadowRoundTrip(outReq.WithContext(ctx), backend)
+		if primary := <-m.primary; primary.reached {
+			h.recordMirror(requestId, backend, primary, shadow)
+		}
+	}()
+	return m
+}
+
+func (h *ServiceHandler) shadowRoundTrip(req *http.Request, backend Service) (result mirrorResult) {
+	h.Shadow.Acquire(backend)
+	start := time.Now()
+	res, err := h.Transport.RoundTrip(req)
+	result.duration = time.Now().Sub(start)
+	if err != nil {
+		h.Shadow.Release(backend)
+		h.Shadow.ReportResult(backend, true)
+		result.err = err
+		return
+	}
+	defer h.Shadow.Release(backend)
+	h.Shadow.ReportResult(backend, res.StatusCode >= 502 && res.StatusCode <= 504)
+
+	result.status = res.StatusCode
+	result.size, result.err = io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	return
+}
+
+// recordMirror compares the responses of the real and of the shadow backends.
+func (h *ServiceHandler) recordMirror(requestId string, backend Service, primary, shadow mirrorResult) {
+	result := "match"
+	switch {
+	case shadow.err != nil:
+		result = "error"
+	case shadow.status != primary.status:
+		result = "status_diff"
+	case shadow.size != primary.size:
+		result = "size_diff"
+	}
+	mirrorRequests.Inc(h.Name, result)
+	mirrorDuration.Observe(shadow.duration.Seconds(), h.Name)
+
+	data := map[string]interface{}{
+		"request_id":      requestId,
+		"service":         h.Name,
+		"backend":         backend.Host,
+		"result":          result,
+		"status":          primary.status,
+		"shadow_status":   shadow.status,
+		"size":            primary.size,
+		"shadow_size":     shadow.size,
+		"duration":        primary.duration,
+		"shadow_duration": shadow.duration,
+	}
+	if shadow.err != nil {
+		data["error"] = shadow.err.Error()
+	}
+	if result == "match" {
+		logger.Debugm("mirrored request", data)
+	} else {
+		logger.Infom("the shadow backend answered differently", data)
+	}
+}
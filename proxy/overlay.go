@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+)
+
+// OverlayDiscoverer changes the services found by Base with the ones
+// added and removed at runtime, e.g. from the admin API.
+// The changes are kept in memory only.
+type OverlayDiscoverer struct {
+	Base ServiceDiscoverer
+
+	mu      sync.Mutex
+	added   []Service
+	removed map[string]bool
+}
+
+func NewOverlayDiscoverer(base ServiceDiscoverer) *OverlayDiscoverer {
+	return &OverlayDiscoverer{Base: base, removed: make(map[string]bool)}
+}
+
+func (o *OverlayDiscoverer) Discover() (services []Service, err error) {
+	base, baseErr := o.Base.Discover()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	seen := make(map[string]bool)
+	for _, list := range [][]Service{base, o.added} {
+		for _, s := range list {
+			key := s.String()
+			if o.removed[key] || seen[key] {
+				continue
+			}
+			seen[key] = true
+			services = append(services, s)
+		}
+	}
+
+	if len(services) == 0 {
+		if baseErr == nil {
+			baseErr = fmt.Errorf("no services are available")
+		}
+		return nil, baseErr
+	}
+	return services, nil
+}
+
+// Add makes s discovered, even if it was removed before.
+func (o *OverlayDiscoverer) Add(s Service) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	key := s.String()
+	delete(o.removed, key)
+	for _, a := range o.added {
+		if a.String() == key {
+			return
+		}
+	}
+	o.added = append(o.added, s)
+}
+
+// Remove hides s, whether it was found by Base or added.
+func (o *OverlayDiscoverer) Remove(s Service) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	key := s.String()
+	o.removed[key] = true
+	for i, a := range o.added {
+		if a.String() == key {
+			o.added = append(o.added[:i], o.added[i+1:]...)
+			break
+		}
+	}
+}
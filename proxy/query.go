@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/gigaroby/authproxy/requestid"
+	"net/http"
+	"net/url"
+)
+
+// QueryConf controls how the query parameters of the backend URLs
+// are merged with the ones sent by the clients.
+type QueryConf struct {
+	// Precedence decides the value of the parameters both in the backend URL and in the request:
+	// "backend" (the default) or "client" keep only that value, "append" sends both.
+	Precedence string `json:"precedence"`
+	// Strip lists the parameters of the clients that are not sent to the backends.
+	Strip []string `json:"strip"`
+}
+
+func (c *QueryConf) validate() error {
+	if c == nil {
+		return nil
+	}
+	switch c.Precedence {
+	case "", "backend", "client", "append":
+		return nil
+	}
+	return fmt.Errorf("unknown query precedence %q", c.Precedence)
+}
+
+// mergeQuery returns the query of req to send to a backend whose URL has backendQuery.
+func (c *QueryConf) mergeQuery(req *http.Request, backendQuery string) string {
+	clientQuery := req.URL.RawQuery
+	var strip []string
+	precedence := "backend"
+	if c != nil {
+		strip = c.Strip
+		if c.Precedence != "" {
+			precedence = c.Precedence
+		}
+	}
+
+	if backendQuery == "" && len(strip) == 0 {
+		// don't change the encoding when there's nothing to do
+		return clientQuery
+	}
+
+	client, err := url.ParseQuery(clientQuery)
+	if err != nil {
+		logger.Infom("Can't parse the query of the request", map[string]interface{}{
+			"request_id": requestid.FromContext(req.Context()),
+			"error":      err.Error(),
+		})
+	}
+	backend, err := url.ParseQuery(backendQuery)
+	if err != nil {
+		logger.Infom("Can't parse the query of the backend", map[string]interface{}{
+			"request_id": requestid.FromContext(req.Context()),
+			"error":      err.Error(),
+		})
+	}
+	for _, param := range strip {
+		client.Del(param)
+	}
+
+	for k, vv := range backend {
+		_, inClient := client[k]
+		switch {
+		case !inClient:
+			client[k] = vv
+		case precedence == "backend":
+			client[k] = vv
+		case precedence == "append":
+			client[k] = append(client[k], vv...)
+		}
+	}
+	return client.Encode()
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"github.com/gigaroby/authproxy/aerrors"
+	"github.com/gigaroby/authproxy/authbroker"
+	"github.com/gigaroby/authproxy/limits"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RateLimitConf limits how many requests every app can send to a service.
+// The default rate can be overridden for every plan.
+type RateLimitConf struct {
+	limits.Rate
+	// use a different bucket for every client IP of the same app
+	PerIP bool                   `json:"perIP"`
+	Plans map[string]limits.Rate `json:"plans"`
+}
+
+func (c *RateLimitConf) rateFor(plan string) limits.Rate {
+	if rate, ok := c.Plans[plan]; ok {
+		return rate
+	}
+	return c.Rate
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// rateLimitKey identifies the bucket of the app that sent req.
+func (h *ServiceHandler) rateLimitKey(req *http.Request, msg authbroker.BrokerMessage) string {
+	key := h.Name + ":" + msg["appId"]
+	if h.Conf.RateLimit.PerIP {
+		clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			clientIP = req.RemoteAddr
+		}
+		key += ":" + clientIP
+	}
+	return key
+}
+
+// checkRateLimit sets the RateLimit-* headers and returns an error if
+// the app sent too many requests.
+func (h *ServiceHandler) checkRateLimit(rw http.ResponseWriter, req *http.Request, msg authbroker.BrokerMessage) *aerrors.ResponseError {
+	if h.Conf.RateLimit == nil {
+		return nil
+	}
+	rate := h.Conf.RateLimit.rateFor(msg["plan"])
+	if rate.IsZero() {
+		return nil
+	}
+
+	res := h.Limiter.Allow(h.rateLimitKey(req, msg), rate)
+
+	header := rw.Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	header.Set("RateLimit-Reset", ceilSeconds(res.Reset))
+
+	if res.Allowed {
+		return nil
+	}
+
+	header.Set("Retry-After", ceilSeconds(res.RetryAfter))
+	return &aerrors.ResponseError{
+		Message: "too many requests, slow down",
+		Status:  http.StatusTooManyRequests,
+		Code:    "error.rateLimited",
+	}
+}
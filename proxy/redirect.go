@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"github.com/gigaroby/authproxy/aerrors"
+	"github.com/gigaroby/authproxy/authbroker"
+	"github.com/gigaroby/authproxy/requestid"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const defaultMaxHops = 5
+
+// RedirectConf decides what to do when a backend answers with a redirect.
+// 304 Not Modified is not a redirect and is always sent to the client.
+type RedirectConf struct {
+	// Policy is "reject" (the default, answering 502), "pass" (sending the redirect
+	// to the client, with the Location on the backend changed to the proxy) or "follow"
+	// (sending the request to the Location, only on the same backend).
+	Policy string `json:"policy"`
+	// MaxHops is how many redirects are followed, 5 by default.
+	MaxHops int `json:"maxHops"`
+}
+
+func (c *RedirectConf) policy() string {
+	if c == nil || c.Policy == "" {
+		return "reject"
+	}
+	return c.Policy
+}
+
+func (c *RedirectConf) maxHops() int {
+	if c == nil || c.MaxHops <= 0 {
+		return defaultMaxHops
+	}
+	return c.MaxHops
+}
+
+func isRedirect(status int) bool {
+	return status > 299 && status < 400 && status != http.StatusNotModified
+}
+
+var errRedirect = aerrors.ResponseError{
+	Message: "can't connect to the backend server",
+	Status:  http.StatusBadGateway,
+	Code:    "error.badGateway",
+}
+
+// handleRedirect applies the redirect policy of the service to a redirect from backend,
+// returning the response to send to the client.
+func (h *ServiceHandler) handleRedirect(req *http.Request, res *http.Response, backend Service, msg authbroker.BrokerMessage) (*http.Response, *aerrors.ResponseError) {
+	switch h.Conf.Redirects.policy() {
+	case "pass":
+		h.rewriteLocation(req, res, backend)
+		return res, nil
+	case "follow":
+		return h.followRedirects(req, res, backend, msg)
+	}
+	res.Body.Close()
+	return nil, &errRedirect
+}
+
+func publicScheme(req *http.Request) string {
+	if proto := req.Header.Get("X-Forwarded-Proto"); proto != "" {
+		return proto
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// onBackend tells if path is under the path of backend.
+func onBackend(path string, backend Service) bool {
+	backendPath := strings.TrimSuffix(backend.Path, "/")
+	return path == backendPath || strings.HasPrefix(path, backendPath+"/")
+}
+
+// locationBackend finds the backend of the service an absolute Location points to,
+// preferring the one that served the request.
+func (h *ServiceHandler) locationBackend(location *url.URL, served Service) (found Service, ok bool) {
+	for _, backend := range append([]Service{served}, h.Balancer.Known()...) {
+		if backend.Host != location.Host {
+			continue
+		}
+		if onBackend(location.Path, backend) {
+			return backend, true
+		}
+		if !ok {
+			found, ok = backend, true
+		}
+	}
+	return
+}
+
+// rewriteLocation changes a Location on any backend of the service to the same place through the proxy.
+func (h *ServiceHandler) rewriteLocation(req *http.Request, res *http.Response, backend Service) {
+	location, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		return
+	}
+
+	if location.Host != "" {
+		var ok bool
+		if backend, ok = h.locationBackend(location, backend); !ok {
+			return
+		}
+		location.Scheme = publicScheme(req)
+		location.Host = req.Host
+	}
+	if onBackend(location.Path, backend) {
+		backendPath := strings.TrimSuffix(backend.Path, "/")
+		location.Path = strings.TrimSuffix(h.Path, "/") + location.Path[len(backendPath):]
+		location.RawPath = ""
+	}
+	res.Header.Set("Location", location.String())
+}
+
+// followRedirects sends the request to the Location of the redirects, as long as they are on backend.
+func (h *ServiceHandler) followRedirects(req *http.Request, res *http.Response, backend Service, msg authbroker.BrokerMessage) (*http.Response, *aerrors.ResponseError) {
+	outReq := h.requestToProxy(req, backend).WithContext(req.Context())
+	current := outReq.URL
+
+	for hops := 0; isRedirect(res.StatusCode); hops++ {
+		res.Body.Close()
+		location, err := current.Parse(res.Header.Get("Location"))
+		if hops >= h.Conf.Redirects.maxHops() || err != nil || location.Host != backend.Host {
+			logger.Infom("Can't follow the redirect from the backend", map[string]interface{}{
+				"request_id": requestid.FromContext(req.Context()),
+				"backend":    backend.Host,
+				"location":   res.Header.Get("Location"),
+				"hops":       hops,
+			})
+			return nil, &errRedirect
+		}
+
+		outReq = h.requestToProxy(req, backend).WithContext(req.Context())
+		outReq.URL = location
+		outReq.Host = location.Host
+		switch res.StatusCode {
+		case http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+			// same method and body
+			if seeker, ok := req.Body.(io.Seeker); ok {
+				seeker.Seek(0, 0)
+			} else if req.Body != nil && req.Body != http.NoBody {
+				return nil, &errRedirect
+			}
+		default:
+			if outReq.Method != "GET" && outReq.Method != "HEAD" {
+				outReq.Method = "GET"
+				outReq.Body = nil
+				outReq.ContentLength = 0
+			}
+		}
+		h.requestHeaders(outReq, msg)
+		if outReq.Method == "GET" && outReq.Body == nil {
+			outReq.Header.Del("Content-Type")
+		}
+
+		if res, err = h.Transport.RoundTrip(outReq); err != nil {
+			logger.Infom("Error following the redirect from the backend", map[string]interface{}{
+				"request_id": requestid.FromContext(req.Context()),
+				"backend":    backend.Host,
+				"error":      err.Error(),
+			})
+			return nil, &errRedirect
+		}
+		current = location
+	}
+	return res, nil
+}
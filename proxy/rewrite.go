@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"regexp"
+	"strings"
+)
+
+// RewriteConf changes the path of the requests before they are sent to the backends.
+// The steps are applied in the order of the fields, then the result is appended
+// to the path of the backend. Without it, every request of the service goes
+// to the path of the backend.
+type RewriteConf struct {
+	// PreserveSubPath keeps what follows the path of the service:
+	// /service1/v1/foo is sent to http://backend/service1/foo
+	PreserveSubPath bool   `json:"preserveSubPath"`
+	StripPrefix     string `json:"stripPrefix"`
+	// Regex is replaced by Replacement, which can refer to the groups as $1, $2...
+	Regex       string `json:"regex"`
+	Replacement string `json:"replacement"`
+	AddPrefix   string `json:"addPrefix"`
+
+	regex *regexp.Regexp
+}
+
+func (c *RewriteConf) compile() error {
+	if c == nil || c.Regex == "" {
+		return nil
+	}
+	regex, err := regexp.Compile(c.Regex)
+	c.regex = regex
+	return err
+}
+
+// rewrite returns the path to send to backendPath for a request to path,
+// on a service mounted on servicePath.
+func (c *RewriteConf) rewrite(servicePath, path, backendPath string) string {
+	if c == nil {
+		return backendPath
+	}
+
+	if c.PreserveSubPath {
+		path = strings.TrimPrefix(path, strings.TrimSuffix(servicePath, "/"))
+	}
+	if c.StripPrefix != "" {
+		path = strings.TrimPrefix(path, c.StripPrefix)
+	}
+	if c.regex != nil {
+		path = c.regex.ReplaceAllString(path, c.Replacement)
+	}
+	path = c.AddPrefix + path
+
+	return singleJoiningSlash(backendPath, path)
+}
+
+func singleJoiningSlash(a, b string) string {
+	if b == "" {
+		return a
+	}
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
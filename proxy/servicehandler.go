@@ -2,10 +2,15 @@ package proxy
 
 import (
 	"encoding/json"
+	"github.com/gigaroby/authproxy/accesslog"
 	"github.com/gigaroby/authproxy/aerrors"
 	"github.com/gigaroby/authproxy/authbroker"
+	"github.com/gigaroby/authproxy/identity"
+	"github.com/gigaroby/authproxy/ioextra"
+	"github.com/gigaroby/authproxy/limits"
+	"github.com/gigaroby/authproxy/requestid"
+	"github.com/gigaroby/authproxy/tracing"
 	gorillamux "github.com/gorilla/mux"
-	"io"
 	"math"
 	"net"
 	"net/http"
@@ -13,25 +18,77 @@ import (
 	"time"
 )
 
+// the status logged when the client goes away before the response (as nginx does)
+const statusClientClosedRequest = 499
+
 type ServiceHandler struct {
+	Name      string
 	Path      string
+	Conf      ServiceConf
 	Transport http.RoundTripper
 	Broker    authbroker.AuthenticationBroker
-	Balancer  LoadBalancer
+	Balancer  *LoadBalancer
+	Limiter   limits.Limiter
+	AccessLog *accesslog.Logger
+	Identity  identity.Signer
+	// Dial connects to the backends for protocol upgrades (e.g. WebSocket).
+	// When nil, net.Dial is used.
+	Dial func(network, addr string) (net.Conn, error)
+	// Shadow balances the mirrored requests between the shadow backends.
+	Shadow *LoadBalancer
+
+	concurrency *limits.ConcurrencyLimiter
+	adaptive    *limits.AIMDLimit
+	cache       CacheStore
+	flights     *flightGroup
 }
 
 func NewServiceHandler(name string, conf *ServiceConf, t http.RoundTripper, b authbroker.AuthenticationBroker, lb *LoadBalancer) *ServiceHandler {
-	return &ServiceHandler{
+	h := &ServiceHandler{
+		Name:      name,
 		Path:      (*conf).Path,
+		Conf:      *conf,
 		Transport: t,
 		Broker:    b,
-		Balancer:  *lb,
+		Balancer:  lb,
+		Limiter:   limits.NewRateLimiter(),
+	}
+	h.concurrency, h.adaptive = (*conf).Concurrency.newLimiter()
+	if err := h.Conf.Rewrite.compile(); err != nil {
+		logger.Fatal("Invalid rewrite regex for ", name, ": ", err.Error())
+	}
+	if err := h.Conf.Query.validate(); err != nil {
+		logger.Fatal("Invalid query configuration for ", name, ": ", err.Error())
+	}
+	if err := h.Conf.CORS.validate(); err != nil {
+		logger.Fatal("Invalid CORS configuration for ", name, ": ", err.Error())
+	}
+	if err := h.Conf.Headers.compile(); err != nil {
+		logger.Fatal("Invalid header rules for ", name, ": ", err.Error())
+	}
+	if h.Conf.Cache != nil {
+		store, err := h.Conf.Cache.newStore(name)
+		if err != nil {
+			logger.Fatal("Can't create the cache of ", name, ": ", err.Error())
+		}
+		h.cache = store
+	}
+	if err := h.Conf.Coalesce.validate(h.Conf.Headers); err != nil {
+		logger.Fatal("Invalid coalesce configuration for ", name, ": ", err.Error())
 	}
+	if h.Conf.Coalesce != nil {
+		h.flights = newFlightGroup()
+	}
+	return h
 }
 
 func (h *ServiceHandler) Register(mux *gorillamux.Router) {
-	if h.Path[len(h.Path)-1] != '/' {
-		(*mux).Handle(h.Path+"/", h)
+	subPaths := strings.TrimSuffix(h.Path, "/") + "/"
+	// the sub-paths reach the backends only when they are rewritten
+	if h.Conf.Rewrite != nil {
+		(*mux).PathPrefix(subPaths).Handler(h)
+	} else if h.Path != subPaths {
+		(*mux).Handle(subPaths, h)
 	}
 	(*mux).Handle(h.Path, h)
 }
@@ -64,11 +121,10 @@ func (p *ServiceHandler) requestToProxy(inreq *http.Request, proxyService Servic
 
 	outreq.URL.Scheme = proxyService.Scheme
 	outreq.URL.Host = proxyService.Host
-	outreq.URL.Path = proxyService.Path
+	outreq.URL.Path = p.Conf.Rewrite.rewrite(p.Path, inreq.URL.Path, proxyService.Path)
+	outreq.URL.RawPath = ""
 
-	// we need to pass query params. In the future we can merge
-	//   inreq.RawQuery and proxyService.RawQuery
-	// outreq.URL.RawQuery = proxyService.RawQuery
+	outreq.URL.RawQuery = p.Conf.Query.mergeQuery(inreq, proxyService.RawQuery)
 
 	// Remove hop-by-hop headers to the backend.  Especially
 	// important is "Connection" because we want a persistent
@@ -102,46 +158,72 @@ func (p *ServiceHandler) requestToProxy(inreq *http.Request, proxyService Servic
 }
 
 type JSONError struct {
-	Error   bool                   `json:"error"`
-	Status  int                    `json:"status"`
-	Code    string                 `json:"code"`
-	Message string                 `json:"message"`
-	Data    map[string]interface{} `json:"data"`
+	Error     bool                   `json:"error"`
+	Status    int                    `json:"status"`
+	Code      string                 `json:"code"`
+	Message   string                 `json:"message"`
+	Data      map[string]interface{} `json:"data"`
+	RequestId string                 `json:"requestId,omitempty"`
 }
 
 func writeError(rw http.ResponseWriter, err aerrors.ResponseError) {
 	rw.Header().Set("Content-Type", "application/json")
 	rw.WriteHeader(err.Status)
 	marshalled, _ := json.Marshal(JSONError{
-		Status:  err.Status,
-		Message: err.Message,
-		Error:   true,
-		Data:    make(map[string]interface{}),
-		Code:    err.Code,
+		Status:    err.Status,
+		Message:   err.Message,
+		Error:     true,
+		Data:      make(map[string]interface{}),
+		Code:      err.Code,
+		RequestId: rw.Header().Get(requestid.Header),
 	})
 	rw.Write(marshalled)
 }
 
-func (p *ServiceHandler) doProxyRequest(req *http.Request) (res *http.Response, d time.Duration, outErr error) {
-	proxyService := <-p.Balancer.Services
+func (p *ServiceHandler) doProxyRequest(req *http.Request, msg authbroker.BrokerMessage) (res *http.Response, proxyService Service, d time.Duration, outErr error) {
+	proxyService = <-p.Balancer.Services
 	// proxyService := Service{}
 
-	outReq := p.requestToProxy(req, proxyService)
+	// the span ends when the headers of the response arrive: it doesn't
+	// include the time spent reading the body, which is streamed to the client later
+	ctx, span := tracing.StartSpan(req.Context(), "backend request", tracing.KindClient)
+	defer span.Finish()
+	span.SetAttribute("service", p.Name)
+	span.SetAttribute("backend", proxyService.Host)
+
+	outReq := p.requestToProxy(req, proxyService).WithContext(ctx)
+	p.requestHeaders(outReq, msg)
+	tracing.Inject(span.Context, outReq.Header)
 
 	// p.Transport is always set in New function
+	p.Balancer.Acquire(proxyService)
 	start := time.Now()
 	res, err := p.Transport.RoundTrip(outReq)
 	d = time.Now().Sub(start)
-	if err != nil {
+	if err == nil {
+		span.SetAttribute("http.status_code", res.StatusCode)
+		failed := res.StatusCode >= 502 && res.StatusCode <= 504
+		p.Balancer.ReportResult(proxyService, failed)
+		p.observeLatency(d, failed)
+	} else {
+		p.Balancer.Release(proxyService)
+		p.Balancer.ReportResult(proxyService, true)
+		p.observeLatency(d, true)
+		span.SetError(err.Error())
+		errData := map[string]interface{}{
+			"request_id": requestid.FromContext(req.Context()),
+			"backend":    proxyService.Host,
+			"error":      err.Error(),
+		}
 		netError, ok := err.(net.Error)
 		if ok {
 			if netError.Timeout() {
-				logger.Info("The Backend timed out: ", err.Error())
+				logger.Infom("The Backend timed out", errData)
 			} else {
-				logger.Info("Network error connecting to the backend: ", err.Error())
+				logger.Infom("Network error connecting to the backend", errData)
 			}
 		} else {
-			logger.Info("Error in the backend request (not a Net error): ", err.Error())
+			logger.Infom("Error in the backend request (not a Net error)", errData)
 		}
 
 		outErr = aerrors.ResponseError{
@@ -155,58 +237,143 @@ func (p *ServiceHandler) doProxyRequest(req *http.Request) (res *http.Response,
 }
 
 func (h *ServiceHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	// the id is already there when the request comes through authserver
+	req, requestId := requestid.Ensure(req)
+	rw.Header().Set(requestid.Header, requestId)
+
+	recorder := ioextra.NewResponseWriter(rw)
+	rw = recorder
+
 	var (
 		err     error
+		start   = time.Now()
 		reqData = map[string]interface{}{
 			"remote_address": req.RemoteAddr,
-			"url":            req.URL.String(),
+			"url":            accesslog.Redact(req.URL.String(), nil),
+			"request_id":     requestId,
 		}
 	)
 	logger.Debugm("request initiated", reqData)
+	defer h.recordRequest(reqData)
+	defer h.logAccess(req, recorder, reqData["url"].(string), start, reqData)
+
+	if h.Conf.CORS != nil && isPreflight(req) {
+		reqData["type"] = "preflight"
+		reqData["status"] = h.servePreflight(rw, req)
+		return
+	}
+	// errors must be readable by the browsers too
+	h.corsHeaders(rw.Header(), req)
 
 	if len(req.URL.RawQuery) > 7001 {
+		reqData["status"] = 414
 		writeError(rw, aerrors.ResponseError{Message: "The requested URI is too long for a GET, please use POSTs",
 			Status: 414, Code: "error.requestURITooLong"})
 		return
 	}
 
-	// if !strings.HasPrefix(req.URL.Path, p.path) {
-	//  writeError(rw, aerrors.ResponseError{Message: "Not found",
-	//      Status: 404, Code: "error.notFound"})
-	//  return
-	// } else { // strip that prefix
-	//  req.URL.Path = req.URL.Path[len(p.path):]
-	// }
+	// the size limit applies to the inflated body
+	bodyErr := h.decompressRequest(req)
+	var streamed *limitedBody
+	if bodyErr == nil {
+		streamed, bodyErr = h.limitBody(rw, req)
+	}
+	if bodyErr != nil {
+		reqData["status"] = bodyErr.Status
+		logger.Infom("invalid request body", reqData)
+		writeError(rw, *bodyErr)
+		return
+	}
 
+	authStart := time.Now()
 	authorized, msg, err := h.Broker.Authenticate(req)
+	reqData["auth_duration"] = time.Now().Sub(authStart)
+	reqData["app_id"] = msg["appId"]
+	authorizeDuration.Observe(reqData["auth_duration"].(time.Duration).Seconds(), h.Name)
 
 	if !authorized {
-		writeError(rw, *err.(*aerrors.ResponseError))
+		authErr := *err.(*aerrors.ResponseError)
+		reqData["status"] = authErr.Status
+		authorizeFailures.Inc(h.Name, authErr.Code)
+		writeError(rw, authErr)
+		return
+	}
+
+	// the broker may have read a form encoded body looking for the credentials
+	if streamed != nil && streamed.exceeded {
+		reqData["status"] = errRequestTooLarge.Status
+		writeError(rw, errRequestTooLarge)
 		return
 	}
 
+	if limitErr := h.checkRateLimit(rw, req, msg); limitErr != nil {
+		reqData["status"] = limitErr.Status
+		logger.Infom("request rate limited", reqData)
+		writeError(rw, *limitErr)
+		return
+	}
+
+	// upgraded connections last long, they don't take a slot
+	if h.Conf.Upgrade != nil && isUpgrade(req) {
+		h.serveUpgrade(rw, req, msg, reqData)
+		return
+	}
+
+	cacheKey, cached, fresh := h.cacheLookup(req)
+	if fresh {
+		h.serveCached(rw, req, cached, msg, reqData)
+		return
+	}
+
+	release, slotErr := h.acquireSlot(req, msg)
+	if slotErr != nil {
+		reqData["status"] = slotErr.Status
+		logger.Infom("request refused, service overloaded", reqData)
+		writeError(rw, *slotErr)
+		return
+	}
+	defer release()
+
+	// only the requests going to the backends are compared
+	shadow := h.startMirror(req, msg)
+	if shadow != nil {
+		defer shadow.done(reqData)
+	}
+
 	var res *http.Response
+	var backend Service
 	var duration time.Duration
-
-	err = attempt(3, 50*time.Millisecond, func() error {
-		if seeker, ok := req.Body.(io.Seeker); ok {
-			seeker.Seek(0, 0)
-		}
-		res, duration, err = h.doProxyRequest(req)
-		return err
-	})
+	var attempts int
+	// shared responses are already read from the backend
+	var shared bool
+	if key := h.coalesceKey(req); key != "" {
+		res, backend, duration, attempts, shared, err = h.coalescedRoundTrip(key, req, msg, reqData)
+	} else {
+		res, backend, duration, attempts, err = h.roundTrip(req, msg)
+	}
 
 	url := req.URL.String()
 	shortURL := url[:int(math.Min(200, float64(len(url))))]
 	reqData["url"] = shortURL
 	reqData["type"] = "request"
 	reqData["duration"] = duration
+	reqData["backend"] = backend.Host
+	reqData["attempts"] = attempts
 	if res != nil {
 		reqData["status"] = res.StatusCode
 	} else {
 		reqData["status"] = -1
 	}
 
+	// nobody is waiting for the response anymore
+	if err != nil && req.Context().Err() != nil {
+		reqData["status"] = statusClientClosedRequest
+		logger.Infom("client disconnected", reqData)
+		return
+	}
+	if err != nil && streamed != nil && streamed.exceeded {
+		err = errRequestTooLarge
+	}
 	if err != nil {
 		resError := err.(aerrors.ResponseError)
 		reqData["status"] = resError.Status
@@ -214,26 +381,53 @@ func (h *ServiceHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		writeError(rw, resError)
 		return
 	}
-	defer res.Body.Close()
+	if !shared {
+		defer h.Balancer.Release(backend)
+	}
 
-	if res.StatusCode > 299 && res.StatusCode < 400 {
-		resError := aerrors.ResponseError{
-			Message: "can't connect to the backend server",
-			Status:  http.StatusBadGateway,
-			Code:    "error.badGateway",
+	if isRedirect(res.StatusCode) {
+		var redirectErr *aerrors.ResponseError
+		if res, redirectErr = h.handleRedirect(req, res, backend, msg); redirectErr != nil {
+			reqData["status"] = redirectErr.Status
+			logger.Errorm("Can't handle the redirection from the backend", reqData)
+			writeError(rw, *redirectErr)
+			return
 		}
-		logger.Errorm("Got a redirection from the backend, and we don't want redirections!", reqData)
-		writeError(rw, resError)
-		return
+		reqData["status"] = res.StatusCode
 	}
+	var outcome string
+	if res, outcome = h.cacheResponse(cacheKey, cached, req, res); outcome != "" {
+		reqData["cache"] = outcome
+		reqData["status"] = res.StatusCode
+	}
+	if shadow != nil {
+		res.Body = shadow.count(res.Body)
+	}
+	defer res.Body.Close()
 
 	logger.Infom("request completed successfully", reqData)
 
 	if _, reportErr := h.Broker.Report(res, msg); reportErr != nil {
-		logger.Error("Report call failed, but the show must go on!")
+		logger.Errorm("Report call failed, but the show must go on!", reqData)
 	}
+	h.sendResponse(rw, req, res, msg, reqData)
+}
 
+// sendResponse sends to the client the response of the backend.
+func (h *ServiceHandler) sendResponse(rw http.ResponseWriter, req *http.Request, res *http.Response, msg authbroker.BrokerMessage, reqData map[string]interface{}) {
 	copyHeader(rw.Header(), res.Header)
+	h.responseHeaders(rw.Header(), req, msg)
+	// the policy of the proxy wins over the one of the backend
+	h.corsHeaders(rw.Header(), req)
+	if outcome, ok := reqData["cache"].(string); ok {
+		rw.Header().Set("X-Cache", strings.ToUpper(outcome))
+	}
+	announceTrailers(rw.Header(), res.Trailer)
+	body, done := h.compressResponse(rw, req, res)
 	rw.WriteHeader(res.StatusCode)
-	io.Copy(rw, res.Body)
+	if copyErr := h.copyResponse(body, res); copyErr != nil {
+		reqData["error"] = copyErr.Error()
+		logger.Infom("response interrupted", reqData)
+	}
+	done()
 }
@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"github.com/gigaroby/authproxy/aerrors"
+	"github.com/gigaroby/authproxy/authbroker"
+	"github.com/gigaroby/authproxy/ioextra"
+	"github.com/gigaroby/authproxy/requestid"
+	"github.com/gigaroby/authproxy/tracing"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultIdleTimeout = 60.0
+	handshakeTimeout   = 10 * time.Second
+)
+
+// UpgradeConf lets the clients of a service switch protocol (e.g. to WebSocket).
+// The broker is called on the handshake and the usage is reported when the connection is closed.
+type UpgradeConf struct {
+	// how long (in seconds) a connection can stay without traffic
+	IdleTimeout float64 `json:"idleTimeout"`
+}
+
+func (c *UpgradeConf) idleTimeout() time.Duration {
+	timeout := c.IdleTimeout
+	if timeout <= 0 {
+		timeout = defaultIdleTimeout
+	}
+	return time.Duration(timeout * float64(time.Second))
+}
+
+func isUpgrade(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range req.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dialBackend opens a connection to the backend, with TLS for https.
+func (h *ServiceHandler) dialBackend(backend Service) (net.Conn, error) {
+	addr := backend.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		if backend.Scheme == "https" {
+			addr += ":443"
+		} else {
+			addr += ":80"
+		}
+	}
+
+	dial := h.Dial
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: handshakeTimeout}).Dial
+	}
+	conn, err := dial("tcp", addr)
+	if err != nil || backend.Scheme != "https" {
+		return conn, err
+	}
+
+	config := &tls.Config{}
+	if t, ok := h.Transport.(*http.Transport); ok && t.TLSClientConfig != nil {
+		config = t.TLSClientConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	return tls.Client(conn, config), nil
+}
+
+// handshake sends the upgrade request to a backend and reads its response.
+func (h *ServiceHandler) handshake(req *http.Request, msg authbroker.BrokerMessage) (conn net.Conn, br *bufio.Reader, res *http.Response, backend Service, err error) {
+	backend = <-h.Balancer.Services
+
+	ctx, span := tracing.StartSpan(req.Context(), "backend upgrade", tracing.KindClient)
+	defer span.Finish()
+	span.SetAttribute("service", h.Name)
+	span.SetAttribute("backend", backend.Host)
+
+	outReq := h.requestToProxy(req, backend).WithContext(ctx)
+	// requestToProxy drops them as hop-by-hop headers
+	outReq.Header = cloneHeader(outReq.Header)
+	outReq.Header.Set("Connection", "Upgrade")
+	outReq.Header.Set("Upgrade", req.Header.Get("Upgrade"))
+	h.requestHeaders(outReq, msg)
+	tracing.Inject(span.Context, outReq.Header)
+
+	conn, err = h.dialBackend(backend)
+	if err == nil {
+		conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err = outReq.Write(conn); err == nil {
+			br = bufio.NewReader(conn)
+			res, err = http.ReadResponse(br, outReq)
+		}
+	}
+	h.Balancer.ReportResult(backend, err != nil)
+
+	if err != nil {
+		span.SetError(err.Error())
+		logger.Infom("Error in the upgrade request to the backend", map[string]interface{}{
+			"request_id": requestid.FromContext(req.Context()),
+			"backend":    backend.Host,
+			"error":      err.Error(),
+		})
+		if conn != nil {
+			conn.Close()
+		}
+		err = aerrors.ResponseError{
+			Message: "can't connect to the backend server",
+			Status:  http.StatusBadGateway,
+			Code:    "error.badGateway",
+		}
+		return
+	}
+	span.SetAttribute("http.status_code", res.StatusCode)
+	conn.SetDeadline(time.Time{})
+	return
+}
+
+func cloneHeader(h http.Header) http.Header {
+	h2 := make(http.Header, len(h))
+	copyHeader(h2, h)
+	return h2
+}
+
+// serveUpgrade proxies a connection switching protocol, until either side closes it
+// or it stays idle for too long.
+func (h *ServiceHandler) serveUpgrade(rw http.ResponseWriter, req *http.Request, msg authbroker.BrokerMessage, reqData map[string]interface{}) {
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		writeError(rw, aerrors.ResponseError{Message: "Protocol upgrades are not supported", Status: 501, Code: "error.notImplemented"})
+		return
+	}
+
+	start := time.Now()
+	backendConn, backendReader, res, backend, err := h.handshake(req, msg)
+	reqData["type"] = "upgrade"
+	reqData["backend"] = backend.Host
+	reqData["attempts"] = 1
+	if err != nil {
+		resError := err.(aerrors.ResponseError)
+		reqData["status"] = resError.Status
+		logger.Errorm("error proxing upgrade request", reqData)
+		writeError(rw, resError)
+		return
+	}
+	h.Balancer.Acquire(backend)
+	defer h.Balancer.Release(backend)
+	defer backendConn.Close()
+	reqData["status"] = res.StatusCode
+
+	// the backend refused to switch, its response is sent as is
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		defer res.Body.Close()
+		if _, reportErr := h.Broker.Report(res, msg); reportErr != nil {
+			logger.Errorm("Report call failed, but the show must go on!", reqData)
+		}
+		copyHeader(rw.Header(), res.Header)
+		h.responseHeaders(rw.Header(), req, msg)
+		rw.WriteHeader(res.StatusCode)
+		io.Copy(rw, res.Body)
+		return
+	}
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		logger.Errorm("can't hijack the client connection: "+err.Error(), reqData)
+		return
+	}
+	defer clientConn.Close()
+
+	res.Header.Set(requestid.Header, rw.Header().Get(requestid.Header))
+	h.responseHeaders(res.Header, req, msg)
+	fmt.Fprintf(clientBuf, "HTTP/1.1 %s\r\n", res.Status)
+	res.Header.Write(clientBuf)
+	clientBuf.WriteString("\r\n")
+	if err := clientBuf.Flush(); err != nil {
+		logger.Infom("can't complete the upgrade with the client: "+err.Error(), reqData)
+		return
+	}
+
+	s := &splice{idle: h.Conf.Upgrade.idleTimeout()}
+	s.touch()
+	sentBytes, receivedBytes := s.run(clientConn, clientBuf.Reader, backendConn, backendReader)
+
+	if recorder, ok := rw.(*ioextra.ResponseWriter); ok {
+		recorder.Bytes += sentBytes
+	}
+	reqData["duration"] = time.Now().Sub(start)
+	reqData["bytes_sent"] = sentBytes
+	reqData["bytes_received"] = receivedBytes
+	logger.Infom("upgraded connection closed", reqData)
+
+	if _, reportErr := h.Broker.Report(res, msg); reportErr != nil {
+		logger.Errorm("Report call failed, but the show must go on!", reqData)
+	}
+}
+
+// splice copies the data between two connections in both directions,
+// closing them when one side is done or both are idle.
+type splice struct {
+	idle time.Duration
+	// last time some data went through, in unix nanoseconds
+	last int64
+}
+
+func (s *splice) touch() {
+	atomic.StoreInt64(&s.last, time.Now().UnixNano())
+}
+
+func (s *splice) idleFor() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&s.last))
+}
+
+// copy reads from src (buffered from srcConn) and writes to dst.
+func (s *splice) copy(dst net.Conn, src io.Reader, srcConn net.Conn) (written int64) {
+	buf := make([]byte, 32*1024)
+	for {
+		srcConn.SetReadDeadline(time.Now().Add(s.idle))
+		n, err := src.Read(buf)
+		if n > 0 {
+			s.touch()
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return
+			}
+			written += int64(n)
+		}
+		if err != nil {
+			// the other direction may still be busy
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && s.idleFor() < s.idle {
+				continue
+			}
+			return
+		}
+	}
+}
+
+// run returns the bytes sent to the client and those received from it.
+func (s *splice) run(clientConn net.Conn, clientReader io.Reader, backendConn net.Conn, backendReader io.Reader) (sent, received int64) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		received = s.copy(backendConn, clientReader, clientConn)
+		// unblock the other direction
+		clientConn.Close()
+		backendConn.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		sent = s.copy(clientConn, backendReader, backendConn)
+		clientConn.Close()
+		backendConn.Close()
+	}()
+	wg.Wait()
+	return
+}
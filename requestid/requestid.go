@@ -0,0 +1,63 @@
+// Requestid identifies every request with an id that is passed to the
+// backends and to 3scale, logged and returned to the client, so that a
+// request can be followed end to end.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+const (
+	Header = "X-Request-Id"
+
+	maxLength = 128
+)
+
+type contextKey struct{}
+
+// New generates a random request id.
+func New() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("requestid: can't generate ids: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// Valid tells if an id sent by a client can be trusted: it must be
+// short and made of printable ASCII characters only.
+func Valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// Ensure makes sure req has a valid request id, generating one if needed,
+// and returns the request carrying it in its context.
+func Ensure(req *http.Request) (*http.Request, string) {
+	id := req.Header.Get(Header)
+	if !Valid(id) {
+		id = New()
+		req.Header.Set(Header, id)
+	}
+	return req.WithContext(NewContext(req.Context(), id)), id
+}
+
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request id in ctx, or an empty string.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
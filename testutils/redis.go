@@ -0,0 +1,123 @@
+package testutils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FakeRedis is an in-process server speaking enough of the Redis protocol
+// to test the clients: it knows INCR, GET, PEXPIRE (which is ignored) and PING.
+type FakeRedis struct {
+	Addr string
+
+	mu       sync.Mutex
+	values   map[string]int64
+	listener net.Listener
+}
+
+func NewFakeRedis() (*FakeRedis, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	f := &FakeRedis{
+		Addr:     listener.Addr().String(),
+		values:   make(map[string]int64),
+		listener: listener,
+	}
+	go f.serve()
+	return f, nil
+}
+
+func (f *FakeRedis) Close() error {
+	return f.listener.Close()
+}
+
+func (f *FakeRedis) Get(key string) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.values[key]
+}
+
+func (f *FakeRedis) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func readHeader(r *bufio.Reader, prefix byte) (n int, err error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) < 2 || line[0] != prefix {
+		return 0, fmt.Errorf("unexpected line %q", line)
+	}
+	return strconv.Atoi(line[1:])
+}
+
+func readCommand(r *bufio.Reader) (args []string, err error) {
+	n, err := readHeader(r, '*')
+	if err != nil {
+		return
+	}
+	for i := 0; i < n; i++ {
+		var size int
+		if size, err = readHeader(r, '$'); err != nil {
+			return
+		}
+		arg := make([]byte, size+2)
+		if _, err = io.ReadFull(r, arg); err != nil {
+			return
+		}
+		args = append(args, string(arg[:size]))
+	}
+	return
+}
+
+func (f *FakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	for {
+		args, err := readCommand(r)
+		if err != nil || len(args) == 0 {
+			return
+		}
+		conn.Write([]byte(f.exec(args)))
+	}
+}
+
+func (f *FakeRedis) exec(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "INCR":
+		f.values[args[1]]++
+		return ":" + strconv.FormatInt(f.values[args[1]], 10) + "\r\n"
+	case "PEXPIRE":
+		return ":1\r\n"
+	case "GET":
+		value, ok := f.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		s := strconv.FormatInt(value, 10)
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
@@ -0,0 +1,221 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	otlpBatchSize     = 512
+	otlpQueueSize     = 4096
+	otlpFlushInterval = 5 * time.Second
+)
+
+// OTLP/JSON representation of the spans
+// https://github.com/open-telemetry/opentelemetry-proto
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	TraceState        string          `json:"traceState,omitempty"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func toOTLPValue(v interface{}) otlpValue {
+	switch value := v.(type) {
+	case bool:
+		return otlpValue{BoolValue: &value}
+	case int:
+		s := strconv.Itoa(value)
+		return otlpValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(value, 10)
+		return otlpValue{IntValue: &s}
+	case float64:
+		return otlpValue{DoubleValue: &value}
+	}
+	s := fmt.Sprint(v)
+	return otlpValue{StringValue: &s}
+}
+
+func toOTLPAttributes(attributes map[string]interface{}) (out []otlpAttribute) {
+	for key, value := range attributes {
+		out = append(out, otlpAttribute{Key: key, Value: toOTLPValue(value)})
+	}
+	return
+}
+
+func toOTLPSpan(s *Span) otlpSpan {
+	out := otlpSpan{
+		TraceID:           s.Context.TraceID.String(),
+		SpanID:            s.Context.SpanID.String(),
+		TraceState:        s.Context.TraceState,
+		Name:              s.Name,
+		Kind:              s.Kind,
+		StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		Attributes:        toOTLPAttributes(s.Attributes),
+	}
+	if s.Parent.IsValid() {
+		out.ParentSpanID = s.Parent.String()
+	}
+	if s.Error != "" {
+		out.Status = otlpStatus{Code: 2, Message: s.Error}
+	}
+	return out
+}
+
+func newOTLPRequest(serviceName string, spans []*Span) *otlpRequest {
+	scopeSpans := otlpScopeSpans{}
+	scopeSpans.Scope.Name = "github.com/gigaroby/authproxy/tracing"
+	for _, span := range spans {
+		scopeSpans.Spans = append(scopeSpans.Spans, toOTLPSpan(span))
+	}
+
+	resourceSpans := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scopeSpans}}
+	resourceSpans.Resource.Attributes = toOTLPAttributes(map[string]interface{}{"service.name": serviceName})
+
+	return &otlpRequest{ResourceSpans: []otlpResourceSpans{resourceSpans}}
+}
+
+// StdoutExporter writes every span, as soon as it ends, as a line of OTLP/JSON.
+type StdoutExporter struct {
+	Out         io.Writer
+	ServiceName string
+
+	mu sync.Mutex
+}
+
+func (e *StdoutExporter) Export(span *Span) {
+	out, err := json.Marshal(newOTLPRequest(e.ServiceName, []*Span{span}))
+	if err != nil {
+		logger.Warning("Can't marshal span: ", err.Error())
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Out.Write(append(out, '\n'))
+}
+
+// OTLPExporter sends the spans in batches to an OTLP/HTTP collector.
+// Spans are dropped when the collector can't keep up.
+type OTLPExporter struct {
+	// Endpoint is the base URL of the collector, e.g. http://localhost:4318
+	Endpoint    string
+	ServiceName string
+
+	client *http.Client
+	spans  chan *Span
+}
+
+func NewOTLPExporter(endpoint, serviceName string, transport http.RoundTripper) *OTLPExporter {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	e := &OTLPExporter{
+		Endpoint:    strings.TrimRight(endpoint, "/"),
+		ServiceName: serviceName,
+		client:      &http.Client{Transport: transport, Timeout: otlpFlushInterval},
+		spans:       make(chan *Span, otlpQueueSize),
+	}
+	go e.loop()
+	return e
+}
+
+func (e *OTLPExporter) Export(span *Span) {
+	select {
+	case e.spans <- span:
+	default:
+		logger.Warning("Span queue full, dropping span ", span.Name)
+	}
+}
+
+func (e *OTLPExporter) loop() {
+	tick := time.NewTicker(otlpFlushInterval)
+	defer tick.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case span := <-e.spans:
+			batch = append(batch, span)
+			if len(batch) < otlpBatchSize {
+				continue
+			}
+		case <-tick.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		e.send(batch)
+		batch = nil
+	}
+}
+
+func (e *OTLPExporter) send(batch []*Span) {
+	body, err := json.Marshal(newOTLPRequest(e.ServiceName, batch))
+	if err != nil {
+		logger.Warning("Can't marshal spans: ", err.Error())
+		return
+	}
+
+	res, err := e.client.Post(e.Endpoint+"/v1/traces", "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Warning("Can't send spans to the collector: ", err.Error())
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode > 299 {
+		logger.Warningf("The collector refused %d spans with status %d", len(batch), res.StatusCode)
+	}
+}
@@ -0,0 +1,266 @@
+// Tracing records spans for the work done on every request and propagates
+// the trace to the backends using the W3C Trace Context headers.
+// http://www.w3.org/TR/trace-context/
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	log "github.com/gigaroby/gopherlog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TraceparentHeader = "Traceparent"
+	TracestateHeader  = "Tracestate"
+
+	flagSampled = 0x01
+)
+
+var (
+	logger = log.GetLogger("authproxy.tracing")
+)
+
+type SpanKind int
+
+// the values are the ones used by OTLP
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+func (s SpanID) IsValid() bool  { return s != SpanID{} }
+
+// SpanContext is the part of a span that is propagated to other services.
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Flags      byte
+	TraceState string
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent formats the span context as a traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// ParseTraceparent parses a traceparent header value. It returns false
+// if the value is malformed, in which case a new trace should be started.
+func ParseTraceparent(value string) (sc SpanContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return
+	}
+	// version 00 has exactly 4 fields, future versions may add more
+	if parts[0] == "00" && len(parts) != 4 {
+		return
+	}
+
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || len(version) != 1 {
+		return
+	}
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != 16 || strings.ToLower(parts[1]) != parts[1] {
+		return
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != 8 || strings.ToLower(parts[2]) != parts[2] {
+		return
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return
+	}
+
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Flags = flags[0]
+	return sc, sc.IsValid()
+}
+
+// Extract reads the span context propagated with the headers of a request.
+func Extract(header http.Header) (sc SpanContext, ok bool) {
+	sc, ok = ParseTraceparent(header.Get(TraceparentHeader))
+	if ok {
+		sc.TraceState = header.Get(TracestateHeader)
+	}
+	return
+}
+
+// Inject writes the span context in the headers of a request.
+func Inject(sc SpanContext, header http.Header) {
+	if !sc.IsValid() {
+		return
+	}
+	header.Set(TraceparentHeader, sc.Traceparent())
+	if sc.TraceState != "" {
+		header.Set(TracestateHeader, sc.TraceState)
+	} else {
+		header.Del(TracestateHeader)
+	}
+}
+
+// Span is a unit of work in a trace.
+type Span struct {
+	Name       string
+	Kind       SpanKind
+	Context    SpanContext
+	Parent     SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	// Error is set when the work failed.
+	Error string
+
+	tracer *Tracer
+	mu     sync.Mutex
+	ended  bool
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Error = message
+}
+
+// Finish ends the span and hands a copy of it to the exporter, so that
+// the attributes set afterwards don't race with the export.
+// Calling Finish more than once has no effect.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	finished := &Span{
+		Name:       s.Name,
+		Kind:       s.Kind,
+		Context:    s.Context,
+		Parent:     s.Parent,
+		Start:      s.Start,
+		End:        s.End,
+		Attributes: make(map[string]interface{}, len(s.Attributes)),
+		Error:      s.Error,
+		tracer:     s.tracer,
+		ended:      true,
+	}
+	for key, value := range s.Attributes {
+		finished.Attributes[key] = value
+	}
+	s.mu.Unlock()
+
+	if s.tracer.Exporter != nil && s.Context.Flags&flagSampled != 0 {
+		s.tracer.Exporter.Export(finished)
+	}
+}
+
+// An Exporter sends finished spans to a collector.
+type Exporter interface {
+	Export(*Span)
+}
+
+// Tracer creates spans. With no Exporter, spans are created and
+// propagated but never recorded.
+type Tracer struct {
+	ServiceName string
+	Exporter    Exporter
+}
+
+var DefaultTracer = &Tracer{ServiceName: "authproxy"}
+
+func randomBytes(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic("tracing: can't generate ids: " + err.Error())
+	}
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying span.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the span in ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// StartSpan starts a span that is a child of the span in ctx, if any.
+func (t *Tracer) StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	var parent SpanContext
+	if p := SpanFromContext(ctx); p != nil {
+		parent = p.Context
+	}
+	span := t.newSpan(name, kind, parent)
+	return ContextWithSpan(ctx, span), span
+}
+
+// StartRemoteSpan starts a span that is a child of the one propagated with header,
+// or the root of a new trace if none was propagated.
+func (t *Tracer) StartRemoteSpan(ctx context.Context, name string, kind SpanKind, header http.Header) (context.Context, *Span) {
+	parent, _ := Extract(header)
+	span := t.newSpan(name, kind, parent)
+	return ContextWithSpan(ctx, span), span
+}
+
+func (t *Tracer) newSpan(name string, kind SpanKind, parent SpanContext) *Span {
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: make(map[string]interface{}),
+		tracer:     t,
+	}
+
+	if parent.IsValid() {
+		span.Context = parent
+		span.Parent = parent.SpanID
+	} else {
+		randomBytes(span.Context.TraceID[:])
+		span.Context.Flags = flagSampled
+	}
+	randomBytes(span.Context.SpanID[:])
+	return span
+}
+
+// StartSpan starts a span with the DefaultTracer.
+func StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	return DefaultTracer.StartSpan(ctx, name, kind)
+}
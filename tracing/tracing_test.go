@@ -0,0 +1,103 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	header := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(header)
+	if !ok {
+		t.Fatal("A valid traceparent was refused")
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" || sc.Flags != 1 {
+		t.Error("The traceparent was parsed wrongly:", sc)
+	}
+	if sc.Traceparent() != header {
+		t.Error("Expected", header, "got", sc.Traceparent())
+	}
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		if _, ok := ParseTraceparent(invalid); ok {
+			t.Error("An invalid traceparent was accepted:", invalid)
+		}
+	}
+}
+
+func TestSpansArePropagated(t *testing.T) {
+	var out bytes.Buffer
+	tracer := &Tracer{ServiceName: "test", Exporter: &StdoutExporter{Out: &out, ServiceName: "test"}}
+
+	incoming := http.Header{}
+	incoming.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	incoming.Set(TracestateHeader, "vendor=value")
+
+	ctx, server := tracer.StartRemoteSpan(context.Background(), "server", KindServer, incoming)
+	_, client := tracer.StartSpan(ctx, "client", KindClient)
+
+	outgoing := http.Header{}
+	Inject(client.Context, outgoing)
+	propagated, ok := Extract(outgoing)
+
+	if !ok || propagated.TraceID != server.Context.TraceID || propagated.SpanID != client.Context.SpanID {
+		t.Error("The client span should be propagated in the same trace, got", outgoing)
+	}
+	if outgoing.Get(TracestateHeader) != "vendor=value" {
+		t.Error("The tracestate should be propagated, got", outgoing.Get(TracestateHeader))
+	}
+	if client.Parent != server.Context.SpanID || server.Parent.String() != "00f067aa0ba902b7" {
+		t.Error("The parents of the spans are wrong")
+	}
+
+	client.SetError("boom")
+	client.Finish()
+	client.Finish()
+
+	var exported otlpRequest
+	if err := json.Unmarshal(out.Bytes(), &exported); err != nil {
+		t.Fatal("The exported span is not valid JSON: ", err, out.String())
+	}
+	spans := exported.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 || spans[0].Name != "client" || spans[0].ParentSpanID != server.Context.SpanID.String() || spans[0].Status.Code != 2 {
+		t.Error("The span was not exported correctly:", out.String())
+	}
+}
+
+type recordExporter struct {
+	spans []*Span
+}
+
+func (e *recordExporter) Export(s *Span) {
+	e.spans = append(e.spans, s)
+}
+
+func TestFinishExportsACopy(t *testing.T) {
+	exporter := &recordExporter{}
+	tracer := &Tracer{ServiceName: "test", Exporter: exporter}
+
+	_, span := tracer.StartSpan(context.Background(), "client", KindClient)
+	span.SetAttribute("backend", "example.com")
+	span.Finish()
+	// e.g. a goroutine still working on the request
+	span.SetAttribute("late", true)
+
+	if len(exporter.spans) != 1 || exporter.spans[0] == span {
+		t.Fatal("A copy of the span should be exported once, got", exporter.spans)
+	}
+	attributes := exporter.spans[0].Attributes
+	if len(attributes) != 1 || attributes["backend"] != "example.com" {
+		t.Error("The exported attributes should be the ones set before Finish, got", attributes)
+	}
+}